@@ -0,0 +1,360 @@
+package netchan
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Balancer picks the client for every payload sent through the Listen dispatcher.
+// All methods are called from a single goroutine of the dispatcher, so a Balancer
+// needs no locking, but it must not be shared by several dispatchers.
+type Balancer interface {
+	// Add is called when the client peer connects, also again after it reconnected.
+	Add(peer string)
+	// Remove is called when the client peer disconnects.
+	Remove(peer string)
+	// Pick returns the client for payload, ok is false when no client is connected.
+	Pick(payload interface{}) (peer string, ok bool)
+	// Sent is called after a payload was handed to peer.
+	Sent(peer string)
+	// Done is called when peer sent a message to the server, it is taken as the reply to one payload.
+	Done(peer string)
+}
+
+// peerList keeps connected clients in the order they connected.
+type peerList []string
+
+// add appends peer unless it is in the list already and reports whether it was added.
+func (l *peerList) add(peer string) bool {
+	for _, p := range *l {
+		if p == peer {
+			return false
+		}
+	}
+	*l = append(*l, peer)
+	return true
+}
+
+// remove deletes peer from the list.
+func (l *peerList) remove(peer string) {
+	for i, p := range *l {
+		if p == peer {
+			*l = append((*l)[:i], (*l)[i+1:]...)
+			return
+		}
+	}
+}
+
+// roundRobin hands payloads to connected clients in turn.
+type roundRobin struct {
+	peers peerList
+	next  int
+}
+
+// RoundRobin returns a Balancer which hands payloads to connected clients in turn.
+func RoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+// Add, Remove, Sent, Done and Pick implement Balancer.
+func (b *roundRobin) Add(peer string)    { b.peers.add(peer) }
+func (b *roundRobin) Remove(peer string) { b.peers.remove(peer) }
+func (b *roundRobin) Sent(peer string)   {}
+func (b *roundRobin) Done(peer string)   {}
+
+func (b *roundRobin) Pick(payload interface{}) (string, bool) {
+	if len(b.peers) == 0 {
+		return "", false
+	}
+	b.next %= len(b.peers)
+	peer := b.peers[b.next]
+	b.next++
+	return peer, true
+}
+
+// leastOutstanding hands every payload to the client with the fewest payloads without reply.
+type leastOutstanding struct {
+	peers       peerList
+	outstanding map[string]int
+}
+
+// LeastOutstanding returns a Balancer which hands every payload to the client with the fewest
+// payloads it did not reply to yet, clients connected earlier win ties.
+func LeastOutstanding() Balancer {
+	return &leastOutstanding{outstanding: make(map[string]int)}
+}
+
+// Add, Remove, Sent, Done and Pick implement Balancer.
+func (b *leastOutstanding) Add(peer string) { b.peers.add(peer) }
+
+func (b *leastOutstanding) Remove(peer string) {
+	b.peers.remove(peer)
+	delete(b.outstanding, peer)
+}
+
+func (b *leastOutstanding) Sent(peer string) { b.outstanding[peer]++ }
+
+func (b *leastOutstanding) Done(peer string) {
+	if b.outstanding[peer] > 0 {
+		b.outstanding[peer]--
+	}
+}
+
+func (b *leastOutstanding) Pick(payload interface{}) (string, bool) {
+	if len(b.peers) == 0 {
+		return "", false
+	}
+	best := b.peers[0]
+	for _, peer := range b.peers[1:] {
+		if b.outstanding[peer] < b.outstanding[best] {
+			best = peer
+		}
+	}
+	return best, true
+}
+
+// weighted hands payloads to clients in proportion to their weights (smooth weighted round-robin).
+type weighted struct {
+	peers   peerList
+	weights map[string]int
+	current map[string]int
+}
+
+// Weighted returns a Balancer which hands payloads to clients in proportion to their weights,
+// keyed by peer ID. Clients without a weight get 1, those with a weight below 1 get nothing.
+// Payloads of one client are spread evenly between those of the others.
+func Weighted(weights map[string]int) Balancer {
+	return &weighted{weights: weights, current: make(map[string]int)}
+}
+
+// Add, Remove, Sent, Done and Pick implement Balancer.
+func (b *weighted) Add(peer string) { b.peers.add(peer) }
+
+func (b *weighted) Remove(peer string) {
+	b.peers.remove(peer)
+	delete(b.current, peer)
+}
+
+func (b *weighted) Sent(peer string) {}
+func (b *weighted) Done(peer string) {}
+
+// weight returns the weight of peer.
+func (b *weighted) weight(peer string) int {
+	weight, ok := b.weights[peer]
+	if !ok {
+		return 1
+	}
+	return weight
+}
+
+func (b *weighted) Pick(payload interface{}) (string, bool) {
+	var best string
+	total := 0
+	for _, peer := range b.peers {
+		weight := b.weight(peer)
+		if weight < 1 {
+			continue
+		}
+		total += weight
+		b.current[peer] += weight
+		if best == "" || b.current[peer] > b.current[best] {
+			best = peer
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	b.current[best] -= total
+	return best, true
+}
+
+// consistentHash hands payloads with the same key to the same client while it is connected.
+type consistentHash struct {
+	peers peerList
+	key   func(payload interface{}) string
+	// ring holds hashes of the virtual nodes of all clients, sorted.
+	ring []uint32
+	// owners maps a virtual node hash to its client.
+	owners map[uint32]string
+}
+
+// hashReplicas is the number of virtual nodes of every client on the hash ring.
+const hashReplicas = 100
+
+// ConsistentHash returns a Balancer which hands payloads with the same key to the same client
+// (sticky routing). When a client connects or disconnects, only the keys of its share move.
+// A nil key uses the payload printed with fmt.Sprint.
+func ConsistentHash(key func(payload interface{}) string) Balancer {
+	if key == nil {
+		key = func(payload interface{}) string { return fmt.Sprint(payload) }
+	}
+	return &consistentHash{key: key, owners: make(map[uint32]string)}
+}
+
+// hashKey hashes s onto the ring.
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// Add, Remove, Sent, Done and Pick implement Balancer.
+func (b *consistentHash) Add(peer string) {
+	if !b.peers.add(peer) {
+		return
+	}
+	for i := 0; i < hashReplicas; i++ {
+		hash := hashKey(peer + "#" + strconv.Itoa(i))
+		if _, taken := b.owners[hash]; taken {
+			// Collisions are rare, the client just has one node less.
+			continue
+		}
+		b.owners[hash] = peer
+		b.ring = append(b.ring, hash)
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i] < b.ring[j] })
+}
+
+func (b *consistentHash) Remove(peer string) {
+	b.peers.remove(peer)
+	ring := b.ring[:0]
+	for _, hash := range b.ring {
+		if b.owners[hash] == peer {
+			delete(b.owners, hash)
+			continue
+		}
+		ring = append(ring, hash)
+	}
+	b.ring = ring
+}
+
+func (b *consistentHash) Sent(peer string) {}
+func (b *consistentHash) Done(peer string) {}
+
+func (b *consistentHash) Pick(payload interface{}) (string, bool) {
+	if len(b.ring) == 0 {
+		return "", false
+	}
+	hash := hashKey(b.key(payload))
+	i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= hash })
+	if i == len(b.ring) {
+		i = 0
+	}
+	return b.owners[b.ring[i]], true
+}
+
+// memberChange tells that a client was added to or removed from the address book.
+type memberChange struct {
+	peer   string
+	joined bool
+}
+
+// membership queues address book changes for the balancer. Unlike events it never drops one,
+// a lost change would leave a client without work or keep a gone client in the balancer forever.
+type membership struct {
+	// lock is a channel used to control access to changes (one at a time).
+	lock    chan int
+	changes []memberChange
+	// signal has a value while changes is not empty.
+	signal chan struct{}
+}
+
+// newMembership creates an empty queue of address book changes.
+func newMembership() *membership {
+	return &membership{lock: make(chan int, 1), signal: make(chan struct{}, 1)}
+}
+
+// push queues a change, it never blocks. A nil membership ignores it.
+// A queued change of the same peer is the opposite one, both cancel out, so the queue
+// holds at most one change per client even when nobody takes them.
+func (m *membership) push(peer string, joined bool) {
+	if m == nil {
+		return
+	}
+	m.lock <- 1
+	defer func() { <-m.lock }()
+
+	for i, change := range m.changes {
+		if change.peer == peer {
+			m.changes = append(m.changes[:i], m.changes[i+1:]...)
+			return
+		}
+	}
+	m.changes = append(m.changes, memberChange{peer: peer, joined: joined})
+	select {
+	case m.signal <- struct{}{}:
+	default:
+	}
+}
+
+// take removes and returns all queued changes in the order they happened.
+func (m *membership) take() []memberChange {
+	m.lock <- 1
+	defer func() { <-m.lock }()
+
+	changes := m.changes
+	m.changes = nil
+	return changes
+}
+
+// balance hands payloads from dispatcherSend and redispatch to the clients picked by balancer
+// until ctx is done. Clients join and leave the balancer with the address book changes in members,
+// every sender from ready is reported as Done. In Sync mode it waits until the client application took
+// a payload and signals r.sent for those of dispatcherSend.
+func balance(ctx context.Context, options Options, r *rendezvous, dispatcherSend chan interface{}, redispatch chan interface{}, send chan Message, members *membership, ready chan string) {
+	balancer := options.Balancer
+	// pending holds a payload waiting for a client to connect.
+	var pending interface{}
+	var waiting bool
+	// sent is the rendezvous signal for pending, redispatched payloads were signaled before.
+	var sent chan struct{}
+	for {
+		input := dispatcherSend
+		retry := redispatch
+		if waiting {
+			// Take no new payloads until the pending one is sent.
+			input, retry = nil, nil
+		}
+		select {
+		case data, ok := <-input:
+			if !ok {
+				// Propagate close to all clients.
+				close(send)
+				return
+			}
+			pending, waiting, sent = data, true, r.sent
+		case data := <-retry:
+			pending, waiting, sent = data, true, nil
+		case <-members.signal:
+			for _, change := range members.take() {
+				if change.joined {
+					balancer.Add(change.peer)
+				} else {
+					balancer.Remove(change.peer)
+				}
+			}
+		case peer := <-ready:
+			balancer.Done(peer)
+		case <-ctx.Done():
+			return
+		}
+		if !waiting {
+			continue
+		}
+		peer, ok := balancer.Pick(pending)
+		if !ok {
+			continue
+		}
+		if !dispatch(ctx, send, Message{To: peer, Payload: pending}, options) {
+			return
+		}
+		balancer.Sent(peer)
+		pending, waiting = nil, false
+		if !notify(ctx, sent) {
+			return
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package netchan
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsistentHash(t *testing.T) {
+	b := ConsistentHash(nil)
+	b.Add("a")
+	b.Add("b")
+	b.Add("c")
+	picked, ok := b.Pick("key1")
+	if !ok {
+		t.Fatal("no pick")
+	}
+	// Removing another peer keeps the key where it was.
+	other := "a"
+	if picked == "a" {
+		other = "b"
+	}
+	b.Remove(other)
+	if again, _ := b.Pick("key1"); again != picked {
+		t.Fatal(picked, again)
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	b := Weighted(map[string]int{"a": 3})
+	b.Add("a")
+	b.Add("b")
+	picks := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		peer, _ := b.Pick(nil)
+		picks[peer]++
+	}
+	if picks["a"] != 6 || picks["b"] != 2 {
+		t.Fatal(picks)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	m := newMembership()
+	m.push("a", true)
+	m.push("b", true)
+	// Opposite changes of one peer cancel out.
+	m.push("a", false)
+	if changes := m.take(); len(changes) != 1 || changes[0].peer != "b" {
+		t.Fatal(changes)
+	}
+}
+
+func TestListenBalancer(t *testing.T) {
+	ctx := testContext(t)
+	addr := freeAddr(t)
+	// A small event buffer must not make the balancer miss clients.
+	send, _, err := ListenWithOptions(ctx, addr, Options{Balancer: RoundRobin(), EventBufferSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clients []*Client
+	for _, id := range []string{"a", "b", "c", "d"} {
+		clients = append(clients, startClient(t, ctx, addr, Options{PeerID: id}))
+	}
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < 8; i++ {
+		send <- i
+	}
+	for _, client := range clients {
+		for i := 0; i < 2; i++ {
+			receive(t, client.Receive())
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package netchan
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BroadcastAddress is the reserved Message.To of a message for every connected client.
+const BroadcastAddress = "*"
+
+// BroadcastError is returned by Server.Broadcast when some clients did not get the message.
+type BroadcastError struct {
+	Failed map[string]error // reason by client address
+}
+
+// Error implements the error interface.
+func (e *BroadcastError) Error() string {
+	addresses := make([]string, 0, len(e.Failed))
+	for address := range e.Failed {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	reasons := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", address, e.Failed[address]))
+	}
+	return fmt.Sprintf("netchan: broadcast failed for %d clients (%s)", len(e.Failed), strings.Join(reasons, ", "))
+}
+
+// broadcastRequest asks route to send message to every client, the outcome is returned on result.
+type broadcastRequest struct {
+	ctx     context.Context
+	message Message
+	result  chan broadcastResult
+}
+
+// broadcastResult is the outcome of a broadcastRequest.
+type broadcastResult struct {
+	sent   int              // number of clients that got the message
+	failed map[string]error // reason by client address
+	err    error            // ErrClosed when the send channel of the server was closed
+}
+
+// Broadcast sends a copy of message to every client connected at this moment, To is set to each
+// client address. It returns when every copy was queued for its connection, a client whose queue
+// stays full until ctx is done is skipped. The number of clients that got it is returned,
+// with a *BroadcastError listing the others, ErrExpired if the message expired before it was sent
+// or ErrClosed after Send was closed. A copy that is still waiting when its client disconnects
+// ends up in DeadLetters like any other message.
+func (s *Server) Broadcast(ctx context.Context, message Message) (int, error) {
+	// Clients trust From set by the server, see route.
+	message.From = ""
+	request := broadcastRequest{
+		ctx:     ctx,
+		message: s.options.stamp(message),
+		result:  make(chan broadcastResult, 1),
+	}
+	select {
+	case s.broadcasts <- request:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-s.ctx.Done():
+		return 0, ErrClosed
+	}
+
+	var result broadcastResult
+	select {
+	case result = <-request.result:
+	case <-s.ctx.Done():
+		return 0, ErrClosed
+	}
+	if result.err != nil {
+		return result.sent, result.err
+	}
+	if len(result.failed) > 0 {
+		return result.sent, &BroadcastError{Failed: result.failed}
+	}
+	return result.sent, nil
+}
+
+// broadcast sends a copy of message to every client in the address book. A client whose queue stays
+// full until ctx is done is skipped. It returns false when the server stops.
+func (s *Server) broadcast(ctx context.Context, message Message) (result broadcastResult, ok bool) {
+	result.failed = make(map[string]error)
+	addresses, closed := s.addressBookSnapshot()
+	if closed {
+		result.err = ErrClosed
+		return result, true
+	}
+	if s.expiry.check(message, BroadcastAddress) {
+		result.err = ErrExpired
+		return result, true
+	}
+	for _, address := range addresses {
+		clientSendLanes := s.addressBookManager("get", address, addressBook{})
+		if clientSendLanes == nil {
+			// Client disconnected after the snapshot.
+			result.failed[address] = ErrPeerDisconnected
+			continue
+		}
+		message.To = address
+		lane := clientSendLanes.lane(message.Priority)
+		select {
+		case lane <- message:
+			result.sent++
+			continue
+		default:
+		}
+		select {
+		case lane <- message:
+			result.sent++
+		case <-ctx.Done():
+			result.failed[address] = ctx.Err()
+		case <-s.ctx.Done():
+			return result, false
+		}
+	}
+	return result, true
+}
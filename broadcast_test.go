@@ -0,0 +1,37 @@
+package netchan
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBroadcast(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{})
+	a := startClient(t, ctx, server.Addr().String(), Options{})
+	b := startClient(t, ctx, server.Addr().String(), Options{})
+	time.Sleep(100 * time.Millisecond)
+
+	if n, err := server.Broadcast(ctx, Message{Payload: 1}); n != 2 || err != nil {
+		t.Fatal(n, err)
+	}
+	server.Send() <- Message{To: BroadcastAddress, Payload: 2}
+	for _, client := range []*Client{a, b} {
+		for want := 1; want <= 2; want++ {
+			if v := receivePayload(t, client.Receive()); v != want {
+				t.Fatal(v)
+			}
+		}
+	}
+
+	b.Close()
+	time.Sleep(200 * time.Millisecond)
+	if n, err := server.Broadcast(ctx, Message{Payload: 3}); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	close(server.Send())
+	if _, err := server.Broadcast(ctx, Message{Payload: 4}); !errors.Is(err, ErrClosed) {
+		t.Fatal(err)
+	}
+}
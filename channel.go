@@ -0,0 +1,137 @@
+package netchan
+
+import (
+	"context"
+)
+
+// Channel is a named logical channel multiplexed with other channels over the connections
+// of a Server or Client. Messages sent on it carry its name in Message.Channel and are
+// delivered to the channel with the same name on the other side.
+type Channel struct {
+	name    string
+	send    chan Message
+	receive chan Message
+}
+
+// Name returns the name of the channel.
+func (ch *Channel) Name() string {
+	return ch.name
+}
+
+// Send returns the channel for messages to the peer, Message.Channel is set automatically.
+// It belongs to the caller and is never closed by netchan.
+func (ch *Channel) Send() chan Message {
+	return ch.send
+}
+
+// Receive returns the channel with messages sent by the peer on the channel with the same name.
+// It is closed when the server or client stops.
+func (ch *Channel) Receive() chan Message {
+	return ch.receive
+}
+
+// channelTable holds the named channels of a Server or Client.
+// A channel is created by OpenChannel only, messages which arrive for other names are not delivered.
+type channelTable struct {
+	// lock is a channel used to control access to channels (one at a time).
+	lock chan int
+	// channels maps names to channels.
+	channels map[string]*Channel
+	// closed is set after all receive channels were closed, later channels start closed.
+	closed bool
+	// out is an internal send channel of the owner which is never closed, named channels forward their messages to it.
+	out chan Message
+	// closeFrames sends a KindClose message when the send channel of a named channel is closed.
+	// A server has no single peer to tell, so its named channels just stop forwarding.
+	closeFrames bool
+	ctx         context.Context
+	options     Options
+}
+
+// newChannelTable creates an empty table whose channels forward to out until ctx is canceled.
+func newChannelTable(ctx context.Context, out chan Message, closeFrames bool, options Options) *channelTable {
+	return &channelTable{
+		lock:        make(chan int, 1),
+		channels:    make(map[string]*Channel),
+		out:         out,
+		closeFrames: closeFrames,
+		ctx:         ctx,
+		options:     options,
+	}
+}
+
+// open returns the channel name, it is created if it does not exist yet.
+func (t *channelTable) open(name string) *Channel {
+	t.lock <- 1
+	defer func() { <-t.lock }()
+
+	ch, ok := t.channels[name]
+	if ok {
+		return ch
+	}
+	ch = &Channel{
+		name:    name,
+		send:    make(chan Message, t.options.sendBufferSize()),
+		receive: make(chan Message, t.options.receiveBufferSize()),
+	}
+	if t.closed {
+		close(ch.receive)
+	}
+	t.channels[name] = ch
+	go t.forward(ch)
+	return ch
+}
+
+// receive returns the receive channel of name, nil if it was not opened.
+func (t *channelTable) receive(name string) chan Message {
+	t.lock <- 1
+	defer func() { <-t.lock }()
+
+	ch, ok := t.channels[name]
+	if !ok {
+		return nil
+	}
+	return ch.receive
+}
+
+// closeAll closes the receive channels of all named channels, it may be called more than once.
+// The caller must make sure nobody writes to them anymore.
+func (t *channelTable) closeAll() {
+	t.lock <- 1
+	defer func() { <-t.lock }()
+
+	if t.closed {
+		return
+	}
+	t.closed = true
+	for _, ch := range t.channels {
+		close(ch.receive)
+	}
+}
+
+// forward moves messages from the send channel of ch to the send channel of the owner.
+// Closing the send channel of ch sends a KindClose message for it if closeFrames is set.
+func (t *channelTable) forward(ch *Channel) {
+	for {
+		select {
+		case message, ok := <-ch.send:
+			if !ok && !t.closeFrames {
+				return
+			}
+			if !ok {
+				message = Message{Kind: KindClose}
+			}
+			message.Channel = ch.name
+			select {
+			case t.out <- message:
+			case <-t.ctx.Done():
+				return
+			}
+			if !ok {
+				return
+			}
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
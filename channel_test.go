@@ -0,0 +1,55 @@
+package netchan
+
+import (
+	"testing"
+)
+
+func TestChannels(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{})
+	client := startClient(t, ctx, server.Addr().String(), Options{})
+	serverTasks := server.OpenChannel("tasks")
+	results := client.OpenChannel("results")
+
+	client.OpenChannel("unknown").Send() <- Message{Payload: 9}
+	if d := receiveDeadLetter(t, server.DeadLetters()); d.Reason != ErrUnknownChannel {
+		t.Fatal(d)
+	}
+
+	tasks := client.OpenChannel("tasks")
+	tasks.Send() <- Message{Payload: 1}
+	client.Send() <- Message{Payload: 2}
+	if m := receive(t, server.Receive()); m.Payload.(int) != 2 || m.Channel != "" {
+		t.Fatal(m)
+	}
+	task := receive(t, serverTasks.Receive())
+	if task.Payload.(int) != 1 || task.Channel != "tasks" {
+		t.Fatal(task)
+	}
+	server.OpenChannel("results").Send() <- Message{To: task.From, Payload: 3}
+	if v := receivePayload(t, results.Receive()); v != 3 {
+		t.Fatal(v)
+	}
+
+	// Named channels stay open when the default channels are closed.
+	close(client.Send())
+	close(server.Send())
+	tasks.Send() <- Message{Payload: 4}
+	if v := receivePayload(t, serverTasks.Receive()); v != 4 {
+		t.Fatal(v)
+	}
+	// Sending to a client after the server send channel was closed fails.
+	server.OpenChannel("results").Send() <- Message{To: task.From, Payload: 5}
+	if d := receiveDeadLetter(t, server.DeadLetters()); d.Reason != ErrClosed {
+		t.Fatal(d)
+	}
+
+	close(tasks.Send())
+	if m := receive(t, serverTasks.Receive()); m.Kind != KindClose {
+		t.Fatal(m)
+	}
+	client.Close()
+	if _, ok := <-results.Receive(); ok {
+		t.Fatal("channel open after Close")
+	}
+}
@@ -0,0 +1,37 @@
+package netchan
+
+import (
+	"encoding/gob"
+	"io"
+)
+
+// Encoder writes messages to a connection.
+type Encoder interface {
+	Encode(v interface{}) error
+}
+
+// Decoder reads messages from a connection.
+type Decoder interface {
+	Decode(v interface{}) error
+}
+
+// Codec creates an Encoder and a Decoder for every new connection.
+// Both sides of a connection must use the same Codec.
+type Codec interface {
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+// GobCodec is the default Codec based on encoding/gob.
+// Concrete payload types must be registered with gob.Register.
+type GobCodec struct{}
+
+// NewEncoder returns a gob encoder writing to w.
+func (GobCodec) NewEncoder(w io.Writer) Encoder {
+	return gob.NewEncoder(w)
+}
+
+// NewDecoder returns a gob decoder reading from r.
+func (GobCodec) NewDecoder(r io.Reader) Decoder {
+	return gob.NewDecoder(r)
+}
@@ -0,0 +1,25 @@
+package netchan
+
+import (
+	"time"
+)
+
+// DeadLetter is a message which netchan could not deliver, together with the reason.
+type DeadLetter struct {
+	Message Message   // the message as it was sent
+	Reason  error     // ErrUnknownRecipient, ErrExpired, ErrPeerDisconnected, ErrUnknownChannel, ErrClosed, ErrRelayDenied or an error wrapping ErrEncode or ErrSendFailed
+	Time    time.Time // when the message was given up
+}
+
+// deadLetters delivers undeliverable messages to the application.
+// Sending never blocks: dead letters are dropped when nobody reads them and the buffer is full.
+type deadLetters chan DeadLetter
+
+// put sends a dead letter without blocking the caller, a waiting SendSync gets the reason.
+func (letters deadLetters) put(message Message, reason error) {
+	message.finish(reason)
+	select {
+	case letters <- DeadLetter{Message: message, Reason: reason, Time: time.Now()}:
+	default:
+	}
+}
@@ -0,0 +1,33 @@
+package netchan
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeadLetters(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{})
+	server.Send() <- Message{To: "1.2.3.4:5", Payload: 1}
+	if d := receiveDeadLetter(t, server.DeadLetters()); !errors.Is(d.Reason, ErrUnknownRecipient) || d.Message.Payload.(int) != 1 {
+		t.Fatal(d)
+	}
+
+	client := startClient(t, ctx, server.Addr().String(), Options{})
+	type unregistered struct{ A int }
+	client.Send() <- Message{Payload: unregistered{1}}
+	if d := receiveDeadLetter(t, client.DeadLetters()); !errors.Is(d.Reason, ErrEncode) {
+		t.Fatal(d)
+	}
+	// A message which cannot be encoded does not break the connection.
+	client.Send() <- Message{Payload: 2}
+	if v := receivePayload(t, server.Receive()); v != 2 {
+		t.Fatal(v)
+	}
+
+	server.Send() <- Message{To: "x", Payload: 3, Expires: time.Now().Add(-time.Second)}
+	if d := receiveDeadLetter(t, server.DeadLetters()); !errors.Is(d.Reason, ErrExpired) {
+		t.Fatal(d)
+	}
+}
@@ -0,0 +1,215 @@
+package netchan
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// dedupe remembers recently delivered message IDs of every sender,
+// so retransmissions are not delivered twice (exactly-once mode).
+type dedupe struct {
+	// lock is a channel used to control access to senders (one at a time).
+	lock chan int
+	// window is the number of IDs remembered per sender.
+	window int
+	// retention is how long a sender is remembered after its last message.
+	retention time.Duration
+	// maxSenders is the number of senders remembered, the least recently seen are forgotten first.
+	maxSenders int
+	// senders maps Message.Origin to its window of delivered IDs.
+	senders map[string]*dedupeWindow
+	// file persists senders between restarts, empty disables persistence.
+	file string
+	// dirty is set when senders changed since the last save.
+	dirty bool
+}
+
+// dedupeWindow holds delivered IDs of one sender.
+type dedupeWindow struct {
+	Floor    uint64              // every ID up to Floor was delivered or is too old to tell
+	Seen     map[uint64]struct{} // delivered IDs above Floor
+	Order    []uint64            // delivered IDs in arrival order, oldest first
+	LastSeen time.Time           // arrival of the latest message
+}
+
+// newDedupe creates a dedupe with the window, retention and file of options
+// and loads its state from the file if it exists.
+func newDedupe(options Options) (*dedupe, error) {
+	file := options.DedupeFile
+	d := &dedupe{
+		lock:       make(chan int, 1),
+		window:     options.DedupeWindow,
+		retention:  options.DedupeRetention,
+		maxSenders: options.DedupeMaxSenders,
+		senders:    make(map[string]*dedupeWindow),
+		file:       file,
+	}
+	if file == "" {
+		return d, nil
+	}
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&d.senders); err != nil {
+		return nil, err
+	}
+	for _, w := range d.senders {
+		if w.LastSeen.IsZero() {
+			// Saved by a version without LastSeen, the retention starts now.
+			w.LastSeen = time.Now()
+		}
+	}
+	return d, nil
+}
+
+// add marks the ID of origin as delivered. It returns false if it was delivered before.
+func (d *dedupe) add(origin string, id uint64) bool {
+	d.lock <- 1
+	defer func() { <-d.lock }()
+
+	w, ok := d.senders[origin]
+	if !ok {
+		w = &dedupeWindow{Seen: make(map[uint64]struct{})}
+		d.senders[origin] = w
+	}
+	if id <= w.Floor {
+		return false
+	}
+	if _, ok := w.Seen[id]; ok {
+		return false
+	}
+	w.LastSeen = time.Now()
+	w.Seen[id] = struct{}{}
+	w.Order = append(w.Order, id)
+	for len(w.Order) > d.window {
+		// Forget the oldest ID, everything up to it counts as delivered.
+		oldest := w.Order[0]
+		w.Order = w.Order[1:]
+		delete(w.Seen, oldest)
+		if oldest > w.Floor {
+			w.Floor = oldest
+		}
+	}
+	d.dirty = true
+	return true
+}
+
+// forget removes an ID which was added but could not be delivered, so its retransmission is accepted.
+func (d *dedupe) forget(origin string, id uint64) {
+	d.lock <- 1
+	defer func() { <-d.lock }()
+
+	w, ok := d.senders[origin]
+	if !ok {
+		return
+	}
+	delete(w.Seen, id)
+	for i := len(w.Order) - 1; i >= 0; i-- {
+		if w.Order[i] == id {
+			w.Order = append(w.Order[:i], w.Order[i+1:]...)
+			break
+		}
+	}
+	d.dirty = true
+}
+
+// evict forgets senders which sent nothing for longer than retention and,
+// above maxSenders, the least recently seen ones. A retransmission from a forgotten
+// sender would be delivered again, so retention must exceed the longest reconnect.
+func (d *dedupe) evict(now time.Time) {
+	d.lock <- 1
+	defer func() { <-d.lock }()
+
+	for origin, w := range d.senders {
+		if now.Sub(w.LastSeen) > d.retention {
+			delete(d.senders, origin)
+			d.dirty = true
+		}
+	}
+	if len(d.senders) <= d.maxSenders {
+		return
+	}
+	origins := make([]string, 0, len(d.senders))
+	for origin := range d.senders {
+		origins = append(origins, origin)
+	}
+	sort.Slice(origins, func(i, j int) bool { return d.senders[origins[i]].LastSeen.Before(d.senders[origins[j]].LastSeen) })
+	for _, origin := range origins[:len(origins)-d.maxSenders] {
+		delete(d.senders, origin)
+	}
+	d.dirty = true
+}
+
+// save writes the state to file if it changed. The file is replaced atomically.
+func (d *dedupe) save() error {
+	d.lock <- 1
+	defer func() { <-d.lock }()
+
+	if d.file == "" || !d.dirty {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(d.file), filepath.Base(d.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := gob.NewEncoder(tmp).Encode(d.senders); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), d.file); err != nil {
+		return err
+	}
+	d.dirty = false
+	return nil
+}
+
+// run forgets idle senders and saves the state every interval while it changes,
+// and saves it once more when ctx is canceled.
+func (d *dedupe) run(ctx context.Context, interval time.Duration, log *log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.evict(now)
+			if err := d.save(); err != nil {
+				log.Printf("Failed to save dedupe state to %s: %s", d.file, err)
+			}
+		case <-ctx.Done():
+			if err := d.save(); err != nil {
+				log.Printf("Failed to save dedupe state to %s: %s", d.file, err)
+			}
+			return
+		}
+	}
+}
+
+// newOrigin returns a random identifier for the messages of one server or client instance.
+func newOrigin() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,103 @@
+package netchan
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDedupeWindow(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dedupe")
+	options := Options{DedupeWindow: 3, DedupeFile: file}.withDefaults()
+	d, err := newDedupe(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.add("a", 1) || d.add("a", 1) {
+		t.Fatal("duplicate accepted")
+	}
+	d.add("a", 2)
+	d.add("a", 3)
+	d.add("a", 4)
+	if d.add("a", 1) {
+		t.Fatal("ID below the window accepted")
+	}
+	// A message which was not delivered after all may arrive again.
+	d.forget("a", 4)
+	if !d.add("a", 4) {
+		t.Fatal("forgotten ID rejected")
+	}
+
+	if err := d.save(); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := newDedupe(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.add("a", 3) || !restored.add("a", 5) {
+		t.Fatal("IDs not restored from file")
+	}
+}
+
+func TestDedupeEvictsSenders(t *testing.T) {
+	d, err := newDedupe(Options{DedupeRetention: time.Hour, DedupeMaxSenders: 2}.withDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.add("a", 1)
+	d.add("b", 1)
+	d.add("c", 1)
+	d.evict(time.Now())
+	if len(d.senders) != 2 || d.senders["a"] != nil {
+		t.Fatal(d.senders)
+	}
+	d.evict(time.Now().Add(2 * time.Hour))
+	if len(d.senders) != 0 {
+		t.Fatal(d.senders)
+	}
+}
+
+func TestExactlyOnceAcrossServerRestart(t *testing.T) {
+	ctx := testContext(t)
+	addr := freeAddr(t)
+	options := Options{ExactlyOnce: true, DedupeFile: filepath.Join(t.TempDir(), "dedupe")}
+	server, err := NewServerWithOptions(ctx, addr, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := startClient(t, ctx, addr, Options{Reliable: true, RespawnDelay: 100 * time.Millisecond})
+	go func() {
+		for i := 1; i <= 100; i++ {
+			client.Send() <- Message{Payload: i}
+		}
+	}()
+	got := make(map[int]int)
+	for i := 0; i < 30; i++ {
+		got[receivePayload(t, server.Receive())]++
+	}
+	server.Close()
+	// Messages the stopped server handed to its receive channel were delivered.
+	for m := range server.Receive() {
+		got[m.Payload.(int)]++
+	}
+	time.Sleep(300 * time.Millisecond)
+	server, err = NewServerWithOptions(ctx, addr, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(got) < 100 {
+		got[receivePayload(t, server.Receive())]++
+	}
+	// Retransmitted messages which were already delivered are dropped.
+	select {
+	case m := <-server.Receive():
+		t.Fatal("unexpected message", m)
+	case <-time.After(500 * time.Millisecond):
+	}
+	for payload, n := range got {
+		if n != 1 {
+			t.Fatalf("%d delivered %d times", payload, n)
+		}
+	}
+}
@@ -2,141 +2,858 @@
 package netchan
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
+	"sync"
 	"time"
 )
 
-// respawnLock is a channel used to control the spawning of dial worker routines.
-var respawnLock chan int
+// Client is a single netchan dial instance.
+// Every Client owns its respawn lock, so several clients can dial
+// different servers inside one process without interfering.
+type Client struct {
+	addr string
+	// peerID identifies this client to the server across reconnects.
+	peerID string
 
-// AdvancedDial establishes a secure TLS connection to the given address.
-// It returns two channels for sending and receiving Message structs,
-// and an error if the initial connection setup fails.
-func AdvancedDial(addr string) (sendChan chan Message, receiveChan chan Message, err error) {
+	// send channel for messages from the application to the server.
+	sendChan chan Message
+	// lanes hold messages from sendChan by Priority until the connection sends them.
+	lanes lanes
+	// urgent holds the send channels returned by SendPriority, the index is the Priority and
+	// PriorityNormal is sendChan.
+	urgent lanes
+	// internalSend holds messages produced by netchan itself, for example calls and subscriptions.
+	// Unlike sendChan it is never closed, in queued mode enqueue moves them to the outbox too.
+	internalSend chan Message
+	// receive channel for messages from the server to the application.
+	receiveChan chan Message
+
+	// options holds buffer sizes, timeouts, TLS settings, logger and codec of this client.
+	options Options
+	// logOnce writes repeated dial errors to options.Logger only once.
+	logOnce *onceLogger
+
+	// events delivers connection lifecycle events to the application.
+	events eventStream
+
+	// calls maps CallID of pending Call requests to their reply channels.
+	calls map[uint64]chan Message
+	// lastCallID is the CallID given to the latest Call.
+	lastCallID uint64
+	// callsLock is a channel used to control access to calls (one at a time).
+	callsLock chan int
+
+	// outbox keeps unacknowledged messages across reconnects in reliable mode, nil otherwise.
+	// With Options.QueueDir it is written to disk and every message is sent from it.
+	outbox *outbox
+
+	// dedupe drops retransmitted messages from the server in exactly-once mode, nil otherwise.
+	dedupe *dedupe
+
+	// sequence numbers messages to the server and reorder delivers messages from the server
+	// in the order they were sent in ordered mode, both are nil otherwise.
+	sequence *sequencer
+	reorder  *reorder
+
+	// expiry drops messages whose Expires deadline passed and counts them.
+	expiry *expiry
+
+	// deadLetters delivers messages which could not be delivered to the application.
+	deadLetters deadLetters
+
+	// retry keeps messages whose write failed for the next connection and the reconnect backoff.
+	retry *retryQueue
 
-	// send channel with 1 message queue length.
-	sendChan = make(chan Message, 1)
-	receiveChan = make(chan Message, 1000)
+	// channels holds the named channels multiplexed over the connection to the server.
+	channels *channelTable
 
-	// A channel to signal successful connection
-	connected := make(chan bool)
+	// topics holds the patterns this client subscribed to, they are sent again on every connection.
+	topics *subscriptions
 
-	// Spawn only one dial connection:
-	respawnLock = make(chan int, 1)
+	// receiveClosed is closed when the server closed its send channel and receiveChan was closed because of it.
+	receiveClosed chan struct{}
+
+	// connected is closed after the first successful connection.
+	connected chan struct{}
+	// dialErrors holds the latest dial error until the first connection succeeds.
+	dialErrors chan error
+
+	// respawnLock is a channel used to control the spawning of dial worker routines.
+	respawnLock chan int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// workers counts every goroutine that may write to receiveChan.
+	workers sync.WaitGroup
+	// stopped is closed after all workers exited and receiveChan was closed.
+	stopped chan struct{}
+}
+
+// NewClient establishes a secure TLS connection to the given address and returns a Client handle
+// once the first connection succeeded. The client reconnects automatically after a drop.
+// Options.InitialConnectTimeout and Options.LazyConnect change how long NewClient waits.
+// It stops when ctx is canceled or Close is called: the reconnect loop exits,
+// the current connection is closed and the receive channel is closed after the last
+// message has been delivered to it.
+func NewClient(ctx context.Context, addr string) (*Client, error) {
+	return NewClientWithOptions(ctx, addr, DefaultOptions())
+}
+
+// NewClientWithOptions works like NewClient, but uses the given options instead of the defaults.
+func NewClientWithOptions(ctx context.Context, addr string, options Options) (*Client, error) {
+	options = options.withDefaults()
+	ctx, cancel := context.WithCancel(ctx)
+
+	c := &Client{
+		addr:         addr,
+		options:      options,
+		logOnce:      newOnceLogger(options.Logger),
+		sendChan:     make(chan Message, options.sendBufferSize()),
+		internalSend: make(chan Message, options.SendBufferSize),
+		receiveChan:  make(chan Message, options.receiveBufferSize()),
+		events:       make(eventStream, options.EventBufferSize),
+		deadLetters:  make(deadLetters, options.DeadLetterBufferSize),
+		// Spawn only one dial connection:
+		respawnLock:   make(chan int, 1),
+		connected:     make(chan struct{}),
+		receiveClosed: make(chan struct{}),
+		calls:         make(map[uint64]chan Message),
+		callsLock:     make(chan int, 1),
+		dialErrors:    make(chan error, 1),
+		ctx:           ctx,
+		cancel:        cancel,
+		stopped:       make(chan struct{}),
+	}
+	c.urgent = newLanes(options.sendBufferSize())
+	c.urgent[PriorityNormal] = c.sendChan
+	c.expiry = &expiry{events: c.events, dead: c.deadLetters}
+	c.retry = newRetryQueue(options)
+	c.channels = newChannelTable(ctx, c.internalSend, true, options)
+	c.topics = newSubscriptions()
+
+	peerID, err := newPeerID(options)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	c.peerID = peerID
+
+	// origin identifies messages of this client in reliable and ordered mode.
+	origin, err := newOrigin()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if options.Ordered {
+		c.sequence = newSequencer(origin)
+		c.reorder = newReorder(options.ReorderBufferSize)
+	}
+	if options.QueueDir != "" {
+		c.outbox, err = openOutbox(origin, options.QueueDir, options.Codec)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		// Messages go from the send channel to disk, also while disconnected.
+		c.workers.Add(1)
+		go c.enqueue()
+	} else if options.Reliable {
+		c.outbox = newOutbox(origin)
+	}
+	switch {
+	case options.QueueDir != "":
+		// Queued messages are sent from the outbox in order.
+	case options.Sync:
+		// Sync mode takes the next message only when it can be sent, so there is nothing to overtake.
+		c.lanes = lanes{c.sendChan}
+	default:
+		// Messages are sorted into lanes by priority, also while disconnected.
+		c.lanes = newLanes(options.sendBufferSize())
+		c.workers.Add(1)
+		go c.prioritize()
+	}
+	if options.ExactlyOnce {
+		c.dedupe, err = newDedupe(options)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		c.workers.Add(1)
+		go func() {
+			defer c.workers.Done()
+			c.dedupe.run(ctx, time.Second, options.Logger)
+		}()
+	}
 
 	// Launches a goroutine that periodically tries to run dialWorkerRun.
+	c.workers.Add(1)
+	go c.respawn()
+
+	// Close receive channel once nobody can write to it anymore.
 	go func() {
-		for {
-			respawnLock <- 1
-			time.Sleep(1 * time.Second)
-			go dialWorkerRun(addr, sendChan, receiveChan, connected)
+		c.workers.Wait()
+		select {
+		case <-c.receiveClosed:
+		default:
+			close(c.receiveChan)
 		}
+		c.channels.closeAll()
+		close(c.events)
+		close(c.deadLetters)
+		close(c.stopped)
 	}()
 
+	// In lazy mode the connection is established in background, messages wait in the send channel.
+	if options.LazyConnect {
+		return c, nil
+	}
+
+	// Without InitialConnectTimeout we wait until the server becomes reachable.
+	var timeout <-chan time.Time
+	if options.InitialConnectTimeout > 0 {
+		timer := time.NewTimer(options.InitialConnectTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
 	// Wait for a successful connection signal
-	<-connected
-	return
+	lastErr := fmt.Errorf("%w: no dial attempt finished in %s", ErrUnreachable, options.InitialConnectTimeout)
+	for {
+		select {
+		case <-c.connected:
+			return c, nil
+		case err := <-c.dialErrors:
+			lastErr = err
+		case <-timeout:
+			c.Close()
+			return nil, lastErr
+		case <-ctx.Done():
+			c.Close()
+			return nil, ctx.Err()
+		}
+	}
 }
 
-// dialWorkerRun handles the actual connection setup and messaging for AdvancedDial.
+// Send returns the channel for messages to the server.
+// It belongs to the caller and is never closed by netchan. Closing it sends a close frame
+// to the server, while messages from the server are still received.
+func (c *Client) Send() chan Message {
+	return c.sendChan
+}
+
+// SendPriority returns the channel for messages to the server with priority p, messages sent on it
+// get priority p. Unlike messages with that Priority on Send, they do not wait behind messages
+// of lower priorities which the connection cannot send yet. PriorityNormal returns Send.
+// After Send was closed, messages end up in DeadLetters with ErrClosed.
+func (c *Client) SendPriority(p Priority) chan Message {
+	return c.urgent.lane(p)
+}
+
+// Enqueue writes message to the queue in Options.QueueDir and returns after the write was synced to disk,
+// the message is sent from there like those from Send. It returns the write error, the message is then
+// kept in memory only and still sent, ErrClosed when the client stopped, or ErrNoQueue without QueueDir.
+// Enqueue is not ordered with messages sent on Send.
+func (c *Client) Enqueue(message Message) error {
+	if c.options.QueueDir == "" {
+		return ErrNoQueue
+	}
+	select {
+	case <-c.ctx.Done():
+		return ErrClosed
+	default:
+	}
+	_, err := c.outbox.push(c.options.stamp(message), c.sequence)
+	return err
+}
+
+// SendSync sends message and waits until the server acknowledged it, which it does after handing
+// the message to its receive channel, in Sync mode after the server application took it from there.
+// It returns nil then, the reason when the message was given up (ErrExpired, ErrSendFailed, ErrEncode),
+// ctx.Err() when ctx is done first, while the message stays queued, ErrClosed when the client stops,
+// or ErrNotReliable without Options.Reliable. SendSync is not ordered with messages sent on Send.
+func (c *Client) SendSync(ctx context.Context, message Message) error {
+	if c.outbox == nil {
+		return ErrNotReliable
+	}
+	message.done = make(chan error, 1)
+	if c.options.QueueDir != "" {
+		// Like Enqueue, the message is written to the queue first.
+		if _, err := c.outbox.push(c.options.stamp(message), c.sequence); err != nil {
+			c.options.Logger.Printf("Queue write to %s failed with error: %s, message is kept in memory only\n", c.options.QueueDir, err)
+		}
+	} else {
+		select {
+		case c.internalSend <- message:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.ctx.Done():
+			return ErrClosed
+		}
+	}
+	select {
+	case err := <-message.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.ctx.Done():
+		return ErrClosed
+	}
+}
+
+// Receive returns the channel with messages from the server.
+// It is closed when the client stops or after draining when the server closed its send channel.
+func (c *Client) Receive() chan Message {
+	return c.receiveChan
+}
+
+// OpenChannel returns the named channel name, it is created on first use.
+// Messages sent on it reach the channel with the same name opened by the server,
+// all named channels share the connection of the client. Messages for a name which was
+// not opened end up in DeadLetters with ErrUnknownChannel, and an opened channel must be read,
+// otherwise it blocks the connection. The empty name returns the main channel of Send and Receive.
+// Closing the send channel of a named channel sends a KindClose message on it.
+func (c *Client) OpenChannel(name string) *Channel {
+	if name == "" {
+		return &Channel{send: c.sendChan, receive: c.receiveChan}
+	}
+	return c.channels.open(name)
+}
+
+// ID returns the peer ID of this client. The server uses it as Message.From of messages
+// from this client and as Message.To of messages for it, see Options.PeerID.
+func (c *Client) ID() string {
+	return c.peerID
+}
+
+// Events returns the channel with connection lifecycle events of this client.
+// Events are dropped when the channel is full. It is closed when the client stops.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// DeadLetters returns the channel with messages this client could not deliver and the reason,
+// for example expired messages or messages which the codec cannot encode.
+// Dead letters are dropped when the channel is full. It is closed when the client stops.
+func (c *Client) DeadLetters() <-chan DeadLetter {
+	return c.deadLetters
+}
+
+// Expired returns the number of messages this client dropped because their Expires deadline passed.
+func (c *Client) Expired() uint64 {
+	return c.expiry.total()
+}
+
+// Close stops the client and waits until all its goroutines exited.
+func (c *Client) Close() error {
+	c.cancel()
+	<-c.stopped
+	return nil
+}
+
+// respawn keeps exactly one dial worker running until the client stops.
+func (c *Client) respawn() {
+	defer c.workers.Done()
+	for {
+		select {
+		case c.respawnLock <- 1:
+		case <-c.ctx.Done():
+			return
+		}
+		// After failed writes the client backs off before it connects again.
+		delay := c.options.RespawnDelay
+		if backoff := c.retry.backoff(); backoff > delay {
+			delay = backoff
+		}
+		select {
+		case <-time.After(delay):
+		case <-c.ctx.Done():
+			<-c.respawnLock
+			return
+		}
+		c.workers.Add(1)
+		go func() {
+			defer c.workers.Done()
+			c.dialWorkerRun()
+		}()
+	}
+}
+
+// dialWorkerRun handles the actual connection setup and messaging for the Client.
 // It manages the TLS connection and forwards messages between the client and server.
-func dialWorkerRun(addr string, sendChan chan Message, receiveChan chan Message, connected chan bool) {
+func (c *Client) dialWorkerRun() {
 	defer func() {
-		<-respawnLock
+		<-c.respawnLock
 	}()
 
-	tlsConfig, err := generateTLSConfig()
+	log := c.options.Logger
+
+	tlsConfig, err := c.options.tlsConfig()
 	if err != nil {
-		Printonce(fmt.Sprintf("TLS configuration error: %s", err))
+		c.logOnce.printonce(fmt.Sprintf("TLS configuration error: %s", err))
+		c.dialFailed(err)
 		return
 	}
 
-	clientDisconnectNotifyChan := make(chan string, 100)
+	clientDisconnectNotifyChan := make(chan peerDisconnect, 1)
 
-	log.Println("Attempting to connect to server:", addr)
-	dialer := net.Dialer{Timeout: time.Second * 15}
-	conn, err := tls.DialWithDialer(&dialer, "tcp", addr, tlsConfig)
+	log.Println("Attempting to connect to server:", c.addr)
+	conn, err := c.dial(tlsConfig)
 	if err != nil {
-		Printonce(fmt.Sprintf("Dial destination %s unreachable. Error: %s", addr, err))
+		c.logOnce.printonce(fmt.Sprintf("Dial destination %s unreachable. Error: %s", c.addr, err))
+		c.dialFailed(err)
 		return
-	} else {
-		defer func() {
-			if conn != nil {
-				err := conn.Close()
-				if err != nil {
-					log.Println("Error closing dial connection:", err)
-				}
+	}
+
+	// If connection is successful, send a signal (only one worker runs at a time, so close happens once).
+	select {
+	case <-c.connected:
+		c.events.emit(Reconnected, c.addr, nil)
+	default:
+		close(c.connected)
+		c.events.emit(PeerConnected, c.addr, nil)
+	}
+
+	log.Printf("Dial worker connected to destination %s", c.addr)
+
+	// After the server closed its stream nothing is delivered to receive channel anymore.
+	receive := c.receiveChan
+	select {
+	case <-c.receiveClosed:
+		receive = nil
+	default:
+	}
+
+	// With a queue messages are taken from the outbox instead of the lanes.
+	queued := c.options.QueueDir != ""
+
+	// handleConnection closes the connection when the server disconnects or the client stops.
+	handleConnection(connection{
+		conn:             conn,
+		trustFrom:        true,
+		send:             c.lanes,
+		receive:          receive,
+		disconnectNotify: clientDisconnectNotifyChan,
+		done:             c.ctx.Done(),
+		options:          c.options,
+		events:           c.events,
+		peerClosed:       c.peerClosed,
+		outbox:           c.outbox,
+		queued:           queued,
+		dedupe:           c.dedupe,
+		expiry:           c.expiry,
+		retry:            c.retry,
+		deadLetters:      c.deadLetters,
+		sequence:         c.sequence,
+		reorder:          c.reorder,
+		intercept:        c.deliverReply,
+		channels:         c.channels,
+		greeting:         c.subscribeFrames(),
+		control:          c.internalSend,
+	})
+
+	select {
+	case disconnected := <-clientDisconnectNotifyChan:
+		log.Printf("DIAL closed connection to %s.", disconnected.Address)
+		c.events.emit(PeerDisconnected, disconnected.Address, disconnected.Reason)
+		if c.options.CloseOnDisconnect && disconnected.Reason != ErrClosed {
+			// Stop reconnecting, receive channel is closed after draining.
+			c.cancel()
+		}
+	default:
+	}
+}
+
+// prioritize moves messages from the send channels to the lane of their Priority,
+// the current connection sends higher lanes first. Closing the send channel closes all lanes.
+func (c *Client) prioritize() {
+	defer c.workers.Done()
+	// inputs is the copy of urgent read here, a channel is set to nil after it was closed.
+	inputs := append(lanes(nil), c.urgent...)
+	for inputs[PriorityNormal] != nil || inputs[PriorityHigh] != nil || inputs[PriorityCritical] != nil {
+		var message Message
+		var ok bool
+		var p Priority
+		select {
+		case message, ok = <-inputs[PriorityNormal]:
+			if !ok {
+				c.lanes.close()
+				inputs[PriorityNormal] = nil
+				continue
 			}
-		}()
+			p = message.Priority
+		case message, ok = <-inputs[PriorityHigh]:
+			p = PriorityHigh
+		case message, ok = <-inputs[PriorityCritical]:
+			p = PriorityCritical
+		case <-c.ctx.Done():
+			return
+		}
+		if !ok {
+			inputs[p] = nil
+			continue
+		}
+		message.Priority = p
+		if inputs[PriorityNormal] == nil {
+			// Lanes were closed with the send channel.
+			c.deadLetters.put(message, ErrClosed)
+			continue
+		}
+		if !c.toLane(inputs, message) {
+			return
+		}
+	}
+}
 
-		// Handles connection closure if the server disconnects.
-		go func() {
-			for {
-				select {
-				case address := <-clientDisconnectNotifyChan:
-					if address == conn.RemoteAddr().String() {
-						err := conn.Close()
-						if err != nil {
-							log.Printf("DIAL already closed connection to %s.", address)
-						} else {
-							log.Printf("DIAL closed connection to %s.", address)
-						}
-					}
-				}
+// toLane puts message into the lane of its priority. While the lane is full, messages from
+// the send channels of higher priorities in inputs are put into their lanes first,
+// so they do not wait behind it. It returns false when the client stops.
+func (c *Client) toLane(inputs lanes, message Message) bool {
+	for {
+		// Only channels of priorities above that of message are read.
+		above := inputs.above(message.Priority)
+		var urgent Message
+		var ok bool
+		var p Priority
+		select {
+		case c.lanes.lane(message.Priority) <- message:
+			return true
+		case urgent, ok = <-above[PriorityHigh]:
+			p = PriorityHigh
+		case urgent, ok = <-above[PriorityCritical]:
+			p = PriorityCritical
+		case <-c.ctx.Done():
+			return false
+		}
+		if !ok {
+			inputs[p] = nil
+			continue
+		}
+		urgent.Priority = p
+		if !c.toLane(inputs, urgent) {
+			return false
+		}
+	}
+}
+
+// enqueue moves messages from the send channel and the SendPriority channels to the write-ahead log
+// in Options.QueueDir, the current connection sends them from there. Closing the send channel queues
+// a KindClose frame, so it reaches the server after all messages queued before. Netchan messages like
+// calls are not written to the queue, they are only valid for the running client.
+func (c *Client) enqueue() {
+	defer c.workers.Done()
+	sendChan := c.sendChan
+	// The queue is sent in order, messages of SendPriority channels are queued like the others.
+	inputs := append(lanes(nil), c.urgent...)
+	for {
+		var message Message
+		select {
+		case data, ok := <-sendChan:
+			if !ok {
+				// Later messages of SendPriority channels are dead-lettered.
+				sendChan = nil
+				message = Message{Kind: KindClose}
+				break
 			}
-		}()
+			message = c.options.stamp(data)
+		case data, ok := <-inputs[PriorityHigh]:
+			if message, ok = c.takeQueuedUrgent(inputs, PriorityHigh, data, ok, sendChan == nil); !ok {
+				continue
+			}
+		case data, ok := <-inputs[PriorityCritical]:
+			if message, ok = c.takeQueuedUrgent(inputs, PriorityCritical, data, ok, sendChan == nil); !ok {
+				continue
+			}
+		case <-c.ctx.Done():
+			return
+		}
+		sequence := c.sequence
+		if message.Kind == KindClose {
+			// Close frames are not part of the ordered stream.
+			sequence = nil
+		}
+		if _, err := c.outbox.push(message, sequence); err != nil {
+			c.options.Logger.Printf("Queue write to %s failed with error: %s, message is kept in memory only\n", c.options.QueueDir, err)
+		}
+	}
+}
+
+// takeQueuedUrgent prepares message taken from the SendPriority channel of priority p for the queue,
+// ok tells whether the channel was open. It returns false if there is nothing to queue: the channel
+// was closed and is set to nil in inputs, or the message was dead-lettered because Send was closed before.
+func (c *Client) takeQueuedUrgent(inputs lanes, p Priority, message Message, ok bool, sendClosed bool) (Message, bool) {
+	if !ok {
+		inputs[p] = nil
+		return message, false
+	}
+	message.Priority = p
+	if sendClosed {
+		c.deadLetters.put(message, ErrClosed)
+		return message, false
+	}
+	return c.options.stamp(message), true
+}
+
+// peerClosed closes the receive channel and those of named channels after the server closed its send channel.
+// It is called by the decoder of the current connection, which is the only writer to receiveChan.
+func (c *Client) peerClosed() {
+	close(c.receiveChan)
+	c.channels.closeAll()
+	close(c.receiveClosed)
+}
+
+// dial opens a TCP connection and performs the TLS handshake, each step limited by DialTimeout.
+// Errors are wrapped in ErrUnreachable or ErrTLSHandshake.
+func (c *Client) dial(tlsConfig *tls.Config) (*tls.Conn, error) {
+	dialer := net.Dialer{Timeout: c.options.DialTimeout}
+	rawConn, err := dialer.DialContext(c.ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnreachable, err)
+	}
+
+	// Verify the server name like tls.Dial does, unless verification is disabled.
+	if tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(c.addr)
+		if err != nil {
+			host = c.addr
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	if c.options.ClientCertificate != nil {
+		// Present the dedicated client certificate, not one of TLSConfig which may belong to a server.
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.Certificates = []tls.Certificate{*c.options.ClientCertificate}
+	}
+
+	conn := tls.Client(rawConn, tlsConfig)
+	handshakeCtx, cancel := context.WithTimeout(c.ctx, c.options.DialTimeout)
+	defer cancel()
+	if err := conn.HandshakeContext(handshakeCtx); err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrTLSHandshake, err)
+	}
+	// The server knows this client by its peer ID, also after a reconnect.
+	if err := writeHello(conn, c.peerID, c.options.DialTimeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The server accepts the peer ID or tells why not, for example when it is in use.
+	if err := readWelcome(conn, c.options.DialTimeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialFailed reports a failed dial attempt as event and keeps it for NewClient until the first connection succeeds.
+func (c *Client) dialFailed(err error) {
+	c.events.emit(DialFailed, c.addr, err)
+	select {
+	case <-c.connected:
+		return
+	default:
+	}
+	// Replace the previous error, only the latest one is interesting.
+	select {
+	case <-c.dialErrors:
+	default:
+	}
+	select {
+	case c.dialErrors <- err:
+	default:
+	}
+}
 
-		// If connection is successful, send a signal
-		connected <- true
+// AdvancedDial establishes a secure TLS connection to the given address.
+// It returns two channels for sending and receiving Message structs,
+// and an error if the initial connection setup fails.
+func AdvancedDial(addr string) (sendChan chan Message, receiveChan chan Message, err error) {
+	return AdvancedDialContext(context.Background(), addr)
+}
 
-		log.Printf("Dial worker connected to destination %s", addr)
+// AdvancedDialContext works like AdvancedDial, but stops when ctx is canceled.
+// See NewClient for shutdown details.
+func AdvancedDialContext(ctx context.Context, addr string) (sendChan chan Message, receiveChan chan Message, err error) {
+	return AdvancedDialWithOptions(ctx, addr, DefaultOptions())
+}
 
-		handleConnection(conn, sendChan, receiveChan, clientDisconnectNotifyChan)
+// AdvancedDialWithOptions works like AdvancedDialContext, but uses the given options instead of the defaults.
+func AdvancedDialWithOptions(ctx context.Context, addr string, options Options) (sendChan chan Message, receiveChan chan Message, err error) {
+	c, err := NewClientWithOptions(ctx, addr, options)
+	if err != nil {
+		return
 	}
+	return c.Send(), c.Receive(), nil
 }
 
 // Dial creates channels for sending and receiving data to a specified address.
 // It uses AdvancedDial to establish a network connection and then sets up
 // channels to send and receive data.
 func Dial(address string) (dispatcherSend chan interface{}, dispatcherReceive chan interface{}, err error) {
-	// send channel with 1 message queue length.
-	dispatcherSend = make(chan interface{}, 1)
-	dispatcherReceive = make(chan interface{}, 1000)
+	return DialContext(context.Background(), address)
+}
+
+// DialContext works like Dial, but stops reconnecting and closes the connection
+// when ctx is canceled. dispatcherReceive is closed on shutdown or when the server
+// closed its send channel. Closing dispatcherSend is propagated to the server.
+func DialContext(ctx context.Context, address string) (dispatcherSend chan interface{}, dispatcherReceive chan interface{}, err error) {
+	return DialWithOptions(ctx, address, DefaultOptions())
+}
+
+// DialWithOptions works like DialContext, but uses the given options instead of the defaults.
+func DialWithOptions(ctx context.Context, address string, options Options) (dispatcherSend chan interface{}, dispatcherReceive chan interface{}, err error) {
+	_, dispatcherSend, dispatcherReceive, err = dialDispatcher(ctx, address, options, nil)
+	return
+}
+
+// rendezvous lets a layer on top of the dispatcher channels, like typed channels, stay synchronous
+// in Sync mode, where its channels are not nil. The layer waits for sent after every value it handed to the
+// dispatcher, and signals taken after its application took a value received from the dispatcher.
+type rendezvous struct {
+	// sent gets a signal when the peer application took a value, or it was given up.
+	sent chan struct{}
+	// taken gets a signal when the application took a received value.
+	taken chan struct{}
+}
+
+// newRendezvous returns the rendezvous for the dispatcher channels with options,
+// its channels are nil unless in Sync mode.
+func newRendezvous(options Options) *rendezvous {
+	if !options.Sync {
+		return &rendezvous{}
+	}
+	return &rendezvous{sent: make(chan struct{}), taken: make(chan struct{})}
+}
+
+// dispatch sends message on send for a dispatcher. In Sync mode it waits until the peer application
+// took the message, a message which was given up is in DeadLetters. It returns false when ctx is done.
+func dispatch(ctx context.Context, send chan Message, message Message, options Options) bool {
+	if options.Sync {
+		message.done = make(chan error, 1)
+	}
+	select {
+	case send <- message:
+	case <-ctx.Done():
+		return false
+	}
+	if !options.Sync {
+		return true
+	}
+	select {
+	case err := <-message.done:
+		if err != nil {
+			options.Logger.Printf("Message to %s was given up: %s", message.To, err)
+		}
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// await waits for a signal on ch, a nil ch returns at once. It returns false when ctx is done.
+func await(ctx context.Context, ch chan struct{}) bool {
+	if ch == nil {
+		return true
+	}
+	select {
+	case <-ch:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// notify sends a signal on ch, a nil ch returns at once. It returns false when ctx is done.
+func notify(ctx context.Context, ch chan struct{}) bool {
+	if ch == nil {
+		return true
+	}
+	select {
+	case ch <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// dialDispatcher implements DialWithOptions, it also returns the client, nil if the connection failed.
+// In Sync mode the dispatcher holds a value until the server application took it, r is nil or
+// the rendezvous with the layer on top of the returned channels.
+func dialDispatcher(ctx context.Context, address string, options Options, r *rendezvous) (client *Client, dispatcherSend chan interface{}, dispatcherReceive chan interface{}, err error) {
+	options = options.withDefaults()
+	options.dispatched = options.Sync
+	if r == nil {
+		r = &rendezvous{}
+	}
+
+	dispatcherSend = make(chan interface{}, options.sendBufferSize())
+	dispatcherReceive = make(chan interface{}, options.receiveBufferSize())
 
 	// Establishes a TLS connection to the server.
-	send, receive, err := AdvancedDial(address)
+	client, err = NewClientWithOptions(ctx, address, options)
 	if err != nil {
-		log.Println(err) // Log the error but do not terminate; the server might still be starting.
+		options.Logger.Println(err) // Log the error but do not terminate; the server might still be starting.
 	} else {
+		send, receive := client.Send(), client.Receive()
 		// Handles sending messages to the server.
 		go func() {
+			// Send empty message to server to notify that we are ready to receive messages:
+			readyToReceive := Message{}
+			readyToReceive.To = address
+			if !dispatch(ctx, send, readyToReceive, options) {
+				return
+			}
+
 			for {
 				select {
-				case payload := <-dispatcherSend:
+				case payload, ok := <-dispatcherSend:
+					if !ok {
+						// Propagate close to the server.
+						close(send)
+						return
+					}
 					data := Message{}
 					data.Payload = payload
 					data.To = address
-					send <- data // Sending the constructed message to the server.
+					// Sending the constructed message to the server.
+					if !dispatch(ctx, send, data, options) || !notify(ctx, r.sent) {
+						return
+					}
+				case <-ctx.Done():
+					return
 				}
 			}
 		}()
 
 		// Gouroutine handles receiving messages from server.
 		go func() {
-			// Send empty message to server to notify that we are ready to receive messages:
-			readyToReceive := Message{}
-			readyToReceive.To = address
-			send <- readyToReceive
+			defer close(dispatcherReceive)
 
 			// Loop than will proxy incoming network data to client receive channel:
 			for {
 				select {
-				case data := <-receive:
+				case data, ok := <-receive:
+					if !ok {
+						return
+					}
 					//Sending the constructed message to the client.
-					dispatcherReceive <- data.Payload
+					select {
+					case dispatcherReceive <- data.Payload:
+					case <-ctx.Done():
+						return
+					}
+					// In Sync mode the server waits until the application took the message.
+					if !await(ctx, r.taken) {
+						return
+					}
+					data.handOver()
+				case <-ctx.Done():
+					return
 				}
 			}
 		}()
@@ -0,0 +1,211 @@
+package netchan
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestInitialConnectTimeout(t *testing.T) {
+	addr := freeAddr(t)
+	_, err := NewClientWithOptions(context.Background(), addr, Options{InitialConnectTimeout: 2500 * time.Millisecond})
+	if !errors.Is(err, ErrUnreachable) {
+		t.Fatal(err)
+	}
+	client, err := NewClientWithOptions(context.Background(), addr, Options{LazyConnect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	ctx := testContext(t)
+	dir := t.TempDir()
+	addr := freeAddr(t)
+	options := Options{QueueDir: dir, LazyConnect: true, RespawnDelay: 100 * time.Millisecond}
+	client := startClient(t, ctx, addr, options)
+	for i := 1; i <= 20; i++ {
+		if err := client.Enqueue(Message{Payload: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Close()
+
+	// A new client on the same directory sends the queued messages first.
+	client = startClient(t, ctx, addr, options)
+	for i := 21; i <= 30; i++ {
+		client.Send() <- Message{Payload: i}
+	}
+	server, err := NewServer(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := 1; want <= 30; want++ {
+		if v := receivePayload(t, server.Receive()); v != want {
+			t.Fatal(want, v)
+		}
+	}
+	close(client.Send())
+	if m := receive(t, server.Receive()); m.Kind != KindClose {
+		t.Fatal(m)
+	}
+	// Acknowledged messages are removed from the queue.
+	time.Sleep(200 * time.Millisecond)
+	client.Close()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatal(len(entries))
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	ctx := testContext(t)
+	dir := t.TempDir()
+	addr := freeAddr(t)
+	client := startClient(t, ctx, addr, Options{QueueDir: dir, LazyConnect: true})
+	if cap(client.Send()) != 0 {
+		t.Fatal(cap(client.Send()))
+	}
+	if err := client.Enqueue(Message{Payload: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// The message is on disk when Enqueue returns.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatal(entries)
+	}
+
+	plain := startClient(t, ctx, addr, Options{LazyConnect: true})
+	if err := plain.Enqueue(Message{}); err != ErrNoQueue {
+		t.Fatal(err)
+	}
+}
+
+func TestSendSync(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{Sync: true})
+	client := startClient(t, ctx, server.Addr().String(), Options{Sync: true})
+
+	// Nobody reads the server receive channel, so the message is not acknowledged.
+	timeout, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	if err := client.SendSync(timeout, Message{Payload: 1}); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if v := receivePayload(t, server.Receive()); v != 1 {
+		t.Fatal(v)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- client.SendSync(ctx, Message{Payload: 2}) }()
+	if v := receivePayload(t, server.Receive()); v != 2 {
+		t.Fatal(v)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	plain := startClient(t, ctx, server.Addr().String(), Options{})
+	if err := plain.SendSync(ctx, Message{}); err != ErrNotReliable {
+		t.Fatal(err)
+	}
+
+	queued := startClient(t, ctx, server.Addr().String(), Options{QueueDir: t.TempDir()})
+	go func() { done <- queued.SendSync(ctx, Message{Payload: 3}) }()
+	if v := receivePayload(t, server.Receive()); v != 3 {
+		t.Fatal(v)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// SendSync still works after the send channel was closed.
+	close(queued.Send())
+	go func() {
+		<-server.Receive()
+		<-server.Receive()
+	}()
+	if err := queued.SendSync(ctx, Message{Payload: 4}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentEnqueue(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{Reliable: true})
+	client := startClient(t, ctx, server.Addr().String(), Options{QueueDir: t.TempDir()})
+	const senders, count = 8, 200
+	errs := make(chan error, senders)
+	for g := 0; g < senders; g++ {
+		go func(g int) {
+			for i := 0; i < count; i++ {
+				if err := client.Enqueue(Message{Payload: g*count + i}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(g)
+	}
+	for g := 0; g < senders; g++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every message arrives once, those of one sender in the order they were enqueued.
+	last := make([]int, senders)
+	for g := range last {
+		last[g] = -1
+	}
+	for n := 0; n < senders*count; n++ {
+		v := receivePayload(t, server.Receive())
+		g, i := v/count, v%count
+		if i != last[g]+1 {
+			t.Fatal(g, last[g], i)
+		}
+		last[g] = i
+	}
+}
+
+func TestQueueKeepsOnlyApplicationData(t *testing.T) {
+	ctx := testContext(t)
+	dir := t.TempDir()
+	addr := freeAddr(t)
+	client := startClient(t, ctx, addr, Options{QueueDir: dir, LazyConnect: true})
+	if err := client.Subscribe("news.*"); err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.Call(timeout, 1); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	// Netchan messages wait in memory for the connection, they must not be replayed after a restart.
+	time.Sleep(100 * time.Millisecond)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatal(len(entries))
+	}
+
+	server, err := NewServer(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Handle(func(ctx context.Context, request Message) (interface{}, error) {
+		return request.Payload.(int) * 2, nil
+	})
+	if reply, err := client.Call(ctx, 2); err != nil || reply.(int) != 4 {
+		t.Fatal(reply, err)
+	}
+}
@@ -0,0 +1,42 @@
+package netchan
+
+import (
+	"errors"
+)
+
+var (
+	// ErrClosed is the disconnect reason when a server or client was stopped.
+	ErrClosed = errors.New("netchan: closed")
+	// ErrUnreachable is returned when a TCP connection to the server cannot be established.
+	ErrUnreachable = errors.New("netchan: destination unreachable")
+	// ErrBind is returned when a server cannot listen on the requested address.
+	ErrBind = errors.New("netchan: cannot listen on address")
+	// ErrNoHandler is returned by Client.Call when the server has no Handler.
+	ErrNoHandler = errors.New("netchan: no call handler on server")
+	// ErrTLSHandshake is returned when the TLS handshake with the server fails.
+	ErrTLSHandshake = errors.New("netchan: TLS handshake failed")
+	// ErrHandshake is returned when the peer ID cannot be exchanged or is invalid.
+	ErrHandshake = errors.New("netchan: peer handshake failed")
+	// ErrExpired is the reason of a MessageExpired event and of a DeadLetter of an expired message.
+	ErrExpired = errors.New("netchan: message expired")
+	// ErrUnknownRecipient is the reason of a DeadLetter whose To address is not connected.
+	ErrUnknownRecipient = errors.New("netchan: unknown recipient")
+	// ErrUnknownChannel is the reason of a DeadLetter of a received message for a named channel which was not opened.
+	ErrUnknownChannel = errors.New("netchan: unknown channel")
+	// ErrPeerDisconnected is the reason of a DeadLetter which was still waiting when its peer disconnected.
+	ErrPeerDisconnected = errors.New("netchan: peer disconnected")
+	// ErrSendFailed is wrapped in the reason of a DeadLetter which used up Options.SendRetryAttempts.
+	ErrSendFailed = errors.New("netchan: sending failed")
+	// ErrDecode is wrapped in errors reported by typed channels for received messages the Codec cannot decode.
+	ErrDecode = errors.New("netchan: cannot decode message")
+	// ErrEncode is wrapped in the reason of a DeadLetter which could not be encoded by the Codec.
+	ErrEncode = errors.New("netchan: cannot encode message")
+	// ErrNotReliable is returned by Client.SendSync when the client does not keep messages until acknowledged.
+	ErrNotReliable = errors.New("netchan: acknowledgements need Options.Reliable")
+	// ErrNoQueue is returned by Client.Enqueue when Options.QueueDir is not set.
+	ErrNoQueue = errors.New("netchan: enqueue needs Options.QueueDir")
+	// ErrRelayDenied is the reason of a DeadLetter of a client message which Options.Relay did not allow.
+	ErrRelayDenied = errors.New("netchan: relay denied")
+	// ErrInvalidTopic is returned for a malformed topic or subscription pattern.
+	ErrInvalidTopic = errors.New("netchan: invalid topic")
+)
@@ -0,0 +1,73 @@
+package netchan
+
+import (
+	"time"
+)
+
+// EventType identifies a connection lifecycle event.
+type EventType int
+
+const (
+	// PeerConnected is emitted when a client connects to a server, or a client connects for the first time.
+	PeerConnected EventType = iota + 1
+	// PeerDisconnected is emitted when a connection is closed, Event.Err holds the reason.
+	PeerDisconnected
+	// DialFailed is emitted when a client dial attempt fails, Event.Err holds the reason.
+	DialFailed
+	// Reconnected is emitted when a client connects again after a drop.
+	Reconnected
+	// ListenerBound is emitted when a server has bound its listening port.
+	ListenerBound
+	// DecodeError is emitted when a received message cannot be decoded, Event.Err holds the reason.
+	DecodeError
+	// MessageExpired is emitted when a message is dropped because its Expires deadline passed,
+	// Event.Peer is the peer it came from or was meant for and Event.Err is ErrExpired.
+	MessageExpired
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case PeerConnected:
+		return "PeerConnected"
+	case PeerDisconnected:
+		return "PeerDisconnected"
+	case DialFailed:
+		return "DialFailed"
+	case Reconnected:
+		return "Reconnected"
+	case ListenerBound:
+		return "ListenerBound"
+	case DecodeError:
+		return "DecodeError"
+	case MessageExpired:
+		return "MessageExpired"
+	}
+	return "Unknown"
+}
+
+// Event describes a change of connection state.
+type Event struct {
+	Type EventType
+	Peer string    // peer ID or remote address (or local address for ListenerBound)
+	Err  error     // reason for PeerDisconnected, DialFailed, DecodeError and MessageExpired
+	Time time.Time // when the event happened
+}
+
+// eventStream delivers lifecycle events to the application.
+// Sending never blocks: events are dropped when nobody reads them and the buffer is full.
+type eventStream chan Event
+
+// emit sends an event without blocking the caller.
+func (events eventStream) emit(eventType EventType, peer string, err error) {
+	select {
+	case events <- Event{Type: eventType, Peer: peer, Err: err, Time: time.Now()}:
+	default:
+	}
+}
+
+// peerDisconnect is sent by handleConnection when a connection is closed.
+type peerDisconnect struct {
+	Address string // peer ID or remote address of the connection
+	Reason  error  // why the connection was closed
+}
@@ -0,0 +1,33 @@
+package netchan
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// expiry drops messages whose Expires deadline passed.
+// It counts them and reports each one as MessageExpired event and as DeadLetter.
+type expiry struct {
+	// count is the number of expired messages so far.
+	count atomic.Uint64
+	// events gets a MessageExpired event for every dropped message.
+	events eventStream
+	// dead gets every dropped message.
+	dead deadLetters
+}
+
+// check reports whether message expired, in that case it is counted and reported with peer.
+func (e *expiry) check(message Message, peer string) bool {
+	if e == nil || !message.expired(time.Now()) {
+		return false
+	}
+	e.count.Add(1)
+	e.events.emit(MessageExpired, peer, ErrExpired)
+	e.dead.put(message, ErrExpired)
+	return true
+}
+
+// total returns the number of expired messages so far.
+func (e *expiry) total() uint64 {
+	return e.count.Load()
+}
@@ -0,0 +1,54 @@
+package netchan
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiredMessagesAreDropped(t *testing.T) {
+	ctx := testContext(t)
+	addr := freeAddr(t)
+	client := startClient(t, ctx, addr, Options{QueueDir: t.TempDir(), LazyConnect: true, RespawnDelay: 100 * time.Millisecond})
+	client.Send() <- Message{Payload: 1, Expires: time.Now().Add(100 * time.Millisecond)}
+	client.Send() <- Message{Payload: 2}
+	time.Sleep(300 * time.Millisecond)
+
+	// The client drops the message which expired while it waited for the server.
+	server, err := NewServer(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := receive(t, server.Receive())
+	if m.Payload.(int) != 2 {
+		t.Fatal(m)
+	}
+	if n := client.Expired(); n != 1 {
+		t.Fatal(n)
+	}
+
+	// The server drops an expired message instead of routing it.
+	server.Send() <- Message{To: m.From, Payload: 3, Expires: time.Now().Add(-time.Second)}
+	server.Send() <- Message{To: m.From, Payload: 4}
+	if v := receivePayload(t, client.Receive()); v != 4 {
+		t.Fatal(v)
+	}
+	if n := server.Expired(); n != 1 {
+		t.Fatal(n)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	options := Options{TTL: time.Minute}
+	before := time.Now()
+	m := options.stamp(Message{})
+	if m.Expires.Before(before.Add(time.Minute)) || m.Expires.After(time.Now().Add(time.Minute)) {
+		t.Fatal(m.Expires)
+	}
+	own := time.Now().Add(time.Hour)
+	if m := options.stamp(Message{Expires: own}); !m.Expires.Equal(own) {
+		t.Fatal(m.Expires)
+	}
+	if m := (Options{}).stamp(Message{}); !m.Expires.IsZero() {
+		t.Fatal(m.Expires)
+	}
+}
@@ -1,37 +1,260 @@
 package netchan
 
 import (
-	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	// "time"
 )
 
+// connection describes a single network connection served by handleConnection.
+type connection struct {
+	conn net.Conn
+	// peerID names the peer in Message.From, events and disconnectNotify, empty uses the remote address.
+	peerID string
+	// trustFrom keeps a Message.From set by the peer, which relays messages of others.
+	// Otherwise From is always overwritten, so a peer cannot pretend to be someone else.
+	trustFrom bool
+	// send holds outgoing messages, one lane per Priority, higher lanes are sent first.
+	// Closing all lanes sends a KindClose frame to the peer.
+	send lanes
+	// receive gets incoming messages, a nil receive drops all incoming data.
+	receive chan Message
+	// disconnectNotify gets the address and reason when the connection is closed.
+	disconnectNotify chan peerDisconnect
+	// done closes the connection and stops every goroutine of handleConnection.
+	done    <-chan struct{}
+	options Options
+	events  eventStream
+	// peerClosed is called when the peer sends a KindClose frame, later data is dropped.
+	// With a nil peerClosed the frame is delivered to receive like any other message.
+	peerClosed func()
+	// outbox keeps sent messages until the peer acknowledges them, nil disables acknowledgements.
+	outbox *outbox
+	// queued takes outgoing messages from outbox as they are added instead of from send,
+	// which is then nil. Used by clients with Options.QueueDir.
+	queued bool
+	// dedupe drops received messages which were delivered before, nil delivers every message.
+	dedupe *dedupe
+	// retry keeps messages without outbox whose write failed for the next connection.
+	retry *retryQueue
+	// deadLetters gets messages which cannot be encoded or used up their send attempts, nil drops them.
+	deadLetters deadLetters
+	// expiry drops expired messages before they are sent or delivered, nil keeps them.
+	expiry *expiry
+	// sequence numbers sent messages, nil sends them without sequence numbers.
+	sequence *sequencer
+	// reorder delivers received messages of every stream in sequence order, nil delivers them as they arrive.
+	reorder *reorder
+	// intercept may consume a received message instead of delivering it to receive, nil delivers every message.
+	intercept func(Message) bool
+	// channels gets received messages with a Message.Channel instead of receive, nil delivers them to receive.
+	channels *channelTable
+	// greeting holds frames sent first on the connection, for example subscriptions of a client.
+	greeting []Message
+	// control holds messages produced by netchan itself, for example calls. They are sent like
+	// those of send, but control is never closed. In queued mode they are kept in memory and sent with the queue.
+	control chan Message
+}
+
 // handleConnection manages a single client connection.
 // It receives and sends messages using the send and receive channels.
-// In case of disconnection, it notifies through the clientDisconnectNotifyChan.
+// Messages waiting in a higher priority lane of send are sent before those in lower lanes.
+// In case of disconnection, it notifies through the disconnectNotify channel with the reason.
 // The function uses goroutines to concurrently handle incoming and outgoing messages.
-func handleConnection(conn net.Conn, send chan Message, receive chan Message, clientDisconnectNotifyChan chan string) {
+// Messages are encoded with options.Codec and log output goes to options.Logger.
+// Messages that cannot be decoded are reported as DecodeError on events.
+// Received messages with an ID are acknowledged after they were handed to the receive channel,
+// duplicates found by dedupe are acknowledged again without delivery.
+// Expired messages are neither sent nor delivered, but acknowledged like delivered ones.
+// With reorder, messages of a stream are delivered in the order of their sequence numbers.
+// With options.FlowControl the peer grants credits in KindCredit frames and no message is sent without one.
+// Messages for a named channel are delivered to that channel of channels.
+func handleConnection(c connection) {
+
+	conn, receive, done, options, events := c.conn, c.receive, c.done, c.options, c.events
+
+	// send is a copy, lanes are set to nil here after they were closed.
+	send := append(lanes(nil), c.send...)
+
+	log := options.Logger
+
+	// peer is the peer ID or remote address used in events.
+	peer := c.peerID
+	if peer == "" {
+		peer = conn.RemoteAddr().String()
+	}
+
+	// reason is the error which made this connection worker exit.
+	var reason error
+
+	// stop tells the decoder goroutine that this connection worker is exiting.
+	stop := make(chan struct{})
+
+	// decoderExited is closed when the decoder goroutine returns.
+	decoderExited := make(chan struct{})
+
+	// delivererExited is closed when the delivery goroutine returns.
+	delivererExited := make(chan struct{})
 
 	// This deferred function notifies about the client disconnection and closes the connection.
 	defer func() {
+		//first close connection and wait for decoder and deliverer, so nothing is written to receive channel after we return
+		close(stop)
 		conn.Close()
-		//then close connection
-		clientDisconnectNotifyChan <- conn.RemoteAddr().String()
-		//first send address to clientDisconnectNotifyChan to clean it from address book
-		//NOTE: defer func() goes reverse direction!
+		<-decoderExited
+		<-delivererExited
+
+		//then send address to disconnectNotify to clean it from address book
+		notice := peerDisconnect{Address: peer, Reason: reason}
+		select {
+		case c.disconnectNotify <- notice:
+		default:
+			select {
+			case c.disconnectNotify <- notice:
+			case <-done:
+			}
+		}
 	}()
 
 	// Channel to collect any errors that occur during connection handling.
 	decodeErrorChannel := make(chan error, 1000)
 
+	// IDs of delivered messages, the main loop acknowledges them to the peer.
+	acks := make(chan uint64, options.ReceiveBufferSize)
+
+	// acked wakes up the main loop in Sync mode when the peer acknowledged a message.
+	acked := make(chan struct{}, 1)
+
+	// inbox passes received messages from the decoder to the delivery goroutine. With flow control
+	// the peer never sends more than fits, so a slow receive channel does not stop the decoder
+	// from reading acknowledgements and credits.
+	inboxSize := 0
+	if options.FlowControl {
+		inboxSize = options.CreditWindow
+	}
+	inbox := make(chan Message, inboxSize)
+
+	// granted passes credits given by the peer to the main loop.
+	granted := make(chan uint64, 1)
+
+	// grants passes credits for the peer from the delivery goroutine to the main loop,
+	// they are given in batches of grantBatch messages.
+	grants := make(chan uint64, 1)
+	grantBatch := uint64(options.CreditWindow/2 + 1)
+
+	// credits is the number of messages the peer is ready to take.
+	// It may go below zero after retransmissions, which are sent without waiting for credits.
+	var credits int64
+
 	// Creating a new decoder and encoder for the connection.
-	decoder := gob.NewDecoder(conn)
-	encoder := gob.NewEncoder(conn)
+	decoder := options.Codec.NewDecoder(conn)
+	encoder := options.Codec.NewEncoder(conn)
+
+	// deliver hands a received message to the receive channel unless it is a duplicate
+	// and acknowledges it. It returns false when the connection worker is exiting.
+	deliver := func(msg Message, duplicate bool) bool {
+		if !duplicate && c.expiry.check(msg, peer) {
+			// Stale data is not delivered, but acknowledged so the peer stops retransmitting it.
+			duplicate = true
+		}
+		if !duplicate && c.intercept != nil && c.intercept(msg) {
+			// Message was consumed by netchan itself (for example a call or a reply).
+			duplicate = true
+		}
+		target := receive
+		if !duplicate && msg.Channel != "" && c.channels != nil {
+			// Message belongs to a named channel multiplexed over this connection.
+			target = c.channels.receive(msg.Channel)
+			if target == nil {
+				// Nobody opened the channel, the message is acknowledged but not delivered.
+				c.deadLetters.put(msg, ErrUnknownChannel)
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			// handedOver is closed by the dispatcher when the application took the message.
+			var handedOver chan struct{}
+			if options.dispatched && target == receive {
+				handedOver = make(chan struct{})
+				msg.handedOver = handedOver
+			}
+			// Send it to the receive channel.
+			select {
+			case target <- msg:
+			case <-stop:
+				c.forget(msg)
+				return false
+			case <-done:
+				c.forget(msg)
+				return false
+			}
+			if handedOver != nil {
+				select {
+				case <-handedOver:
+				case <-stop:
+					return false
+				case <-done:
+					return false
+				}
+			}
+		}
+		if msg.ID != 0 {
+			// Acknowledge only after the message was handed to the application.
+			select {
+			case acks <- msg.ID:
+			case <-stop:
+				return false
+			case <-done:
+				return false
+			}
+		}
+		return true
+	}
+
+	// receiveMessage handles a data message or close frame taken from inbox.
+	// It returns false when the connection worker is exiting.
+	receiveMessage := func(msg Message) bool {
+		if receive == nil {
+			// Peer closed its stream earlier, drop anything it still sends.
+			return true
+		}
+		if msg.Kind == KindClose && msg.Channel == "" && c.peerClosed != nil {
+			// Everything sent before the close frame is already in receive channel.
+			c.peerClosed()
+			receive = nil
+			return true
+		}
+		// duplicate is set for a retransmission of an already delivered message.
+		duplicate := msg.ID != 0 && c.dedupe != nil && !c.dedupe.add(msg.Origin, msg.ID)
+		// Update the message with the sender's peer ID or address.
+		if msg.From == "" || !c.trustFrom {
+			msg.From = peer
+		}
+		if !duplicate && msg.Seq != 0 && c.reorder != nil {
+			if c.reorder.add(msg) {
+				// Deliver every message of the stream which is due now, this one may have to wait.
+				for {
+					next, ok := c.reorder.next(msg.Origin)
+					if !ok {
+						return true
+					}
+					if !deliver(next, false) {
+						return false
+					}
+				}
+			}
+			// Message with this sequence number was delivered before.
+			duplicate = true
+		}
+		return deliver(msg, duplicate)
+	}
 
 	// Goroutine for receiving messages.
 	go func() {
+		defer close(decoderExited)
+		defer close(inbox)
 		for {
 			var msg Message
 			err := decoder.Decode(&msg)
@@ -45,39 +268,346 @@ func handleConnection(conn net.Conn, send chan Message, receive chan Message, cl
 					// Send error to decodeErrorChannel and log it.
 					decodeErrorChannel <- err
 					log.Printf("Error while decoding: %s", err)
+					if isDecodeError(err) {
+						events.emit(DecodeError, peer, err)
+					}
 					return
 				}
 			}
-			// Update the message with the sender's address and send it to the receive channel.
-			msg.From = conn.RemoteAddr().String()
-			receive <- msg
+			if msg.Kind == KindAck {
+				// Peer got our message, no need to retransmit it.
+				if c.outbox != nil {
+					c.outbox.ack(msg.ID)
+				}
+				select {
+				case acked <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			if msg.Kind == KindCredit {
+				// Peer is ready for more messages.
+				select {
+				case granted <- msg.ID:
+				case <-stop:
+					return
+				case <-done:
+					return
+				}
+				continue
+			}
+			select {
+			case inbox <- msg:
+			case <-stop:
+				return
+			case <-done:
+				return
+			}
 		}
 	}()
 
+	// Goroutine delivering received messages in the order they were decoded.
+	go func() {
+		defer close(delivererExited)
+		// consumed counts messages taken from inbox since credits were granted last time.
+		var consumed uint64
+		for msg := range inbox {
+			if !receiveMessage(msg) {
+				return
+			}
+			if !options.FlowControl || msg.Kind == KindClose {
+				continue
+			}
+			consumed++
+			if consumed < grantBatch {
+				continue
+			}
+			select {
+			case grants <- consumed:
+				consumed = 0
+			case <-stop:
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// write encodes a message to the peer. A message which the codec cannot encode
+	// is given up as DeadLetter, sending it again would fail again.
+	// When the connection fails, the message is kept for the next connection: in the outbox
+	// if it has one, in the retry queue otherwise. After options.SendRetryAttempts failed
+	// writes it is given up as DeadLetter.
+	write := func(message Message) error {
+		sendingErr := encoder.Encode(message)
+		if sendingErr == nil {
+			c.retry.succeeded()
+			if message.Kind != KindClose {
+				// Close frames are free, every other message takes a credit.
+				credits--
+			}
+			return nil
+		}
+		if isDecodeError(sendingErr) {
+			log.Printf("Encoding failed with error: %s, message is given up\n", sendingErr)
+			reason := fmt.Errorf("%w: %s", ErrEncode, sendingErr)
+			if c.outbox != nil && message.ID != 0 {
+				c.outbox.drop(message.ID, reason)
+			}
+			c.deadLetters.put(message, reason)
+			return nil
+		}
+		c.retry.failed()
+		message.attempts++
+		switch {
+		case options.SendRetryAttempts > 0 && message.attempts >= options.SendRetryAttempts:
+			log.Printf("Sending failed with error: %s, message is given up after %d attempts\n", sendingErr, message.attempts)
+			reason := fmt.Errorf("%w: %s", ErrSendFailed, sendingErr)
+			if c.outbox != nil && message.ID != 0 {
+				c.outbox.drop(message.ID, reason)
+			}
+			c.deadLetters.put(message, reason)
+		case c.outbox != nil && message.ID != 0:
+			// Message stays in outbox and is retransmitted on the next connection.
+			log.Printf("Sending failed with error: %s, message will be retransmitted\n", sendingErr)
+			c.outbox.update(message)
+		default:
+			// Hand the message to the next connection.
+			log.Printf("Sending failed with error: %s, message will be sent on the next connection\n", sendingErr)
+			c.retry.putBack(message)
+		}
+		return sendingErr
+	}
+
+	// sent is the ID of the latest message taken from a queued outbox on this connection.
+	var sent uint64
+
+	// flush sends queued messages which were not sent on this connection yet, oldest first.
+	flush := func() error {
+		for _, message := range c.outbox.after(sent) {
+			if options.Sync && c.outbox.oldest() <= sent {
+				// Previous message is not acknowledged yet.
+				return nil
+			}
+			if options.FlowControl && credits <= 0 {
+				// Peer is not ready for more.
+				return nil
+			}
+			if c.expiry.check(message, peer) {
+				c.outbox.drop(message.ID, ErrExpired)
+				continue
+			}
+			if sendingErr := write(message); sendingErr != nil {
+				return sendingErr
+			}
+			sent = message.ID
+		}
+		return nil
+	}
+
+	// added wakes up the main loop when a message was queued.
+	var added chan struct{}
+
+	if options.FlowControl {
+		// Tell the peer how many messages we are ready to take.
+		if sendingErr := encoder.Encode(Message{Kind: KindCredit, ID: uint64(options.CreditWindow)}); sendingErr != nil {
+			reason = sendingErr
+			return
+		}
+	}
+
+	// Greeting frames restore the state of the previous connection on the peer.
+	for _, message := range c.greeting {
+		if sendingErr := write(message); sendingErr != nil {
+			reason = sendingErr
+			return
+		}
+	}
+
+	if c.queued {
+		added = c.outbox.added
+		// Queued messages include those which were not acknowledged on the previous connection.
+		if sendingErr := flush(); sendingErr != nil {
+			reason = sendingErr
+			return
+		}
+	} else if c.outbox != nil {
+		// Retransmit messages which were not acknowledged on the previous connection.
+		for _, message := range c.outbox.unacked() {
+			if c.expiry.check(message, peer) {
+				c.outbox.drop(message.ID, ErrExpired)
+				continue
+			}
+			if sendingErr := write(message); sendingErr != nil {
+				reason = sendingErr
+				return
+			}
+		}
+	}
+
+	// Messages whose write failed on the previous connection are sent before newer ones.
+	for {
+		message, ok := c.retry.take()
+		if !ok {
+			break
+		}
+		if c.expiry.check(message, peer) {
+			continue
+		}
+		if sendingErr := write(message); sendingErr != nil {
+			reason = sendingErr
+			return
+		}
+	}
+
+	// transmit sends a message taken from lane p of send, ok is false when the lane was closed.
+	transmit := func(message Message, ok bool, p int) error {
+		// Check if the send lane is closed.
+		if !ok {
+			send[p] = nil
+			if send.open() {
+				// Messages in other lanes are sent first.
+				return nil
+			}
+			// Tell the peer that no more data follows, but keep receiving from it.
+			log.Println("SEND channel closed, sending close frame to peer.")
+			return encoder.Encode(Message{Kind: KindClose})
+		}
+
+		message = options.stamp(message)
+		if c.expiry.check(message, peer) {
+			message.finish(ErrExpired)
+			return nil
+		}
+
+		if c.queued {
+			// Netchan messages are not written to the queue, but sent in order with it.
+			c.outbox.add(message, c.sequence)
+			return flush()
+		}
+		if c.outbox != nil {
+			// Keep the message until the peer acknowledges it.
+			message = c.outbox.add(message, c.sequence)
+		} else {
+			message = c.sequence.next(message)
+		}
+
+		// Attempt to encode and send the message, on failure write keeps it for the next connection.
+		// Logging the sent message is disabled to reduce verbosity.
+		return write(message)
+	}
+
 	// Main loop for handling sending messages and connection errors.
 	for {
+		// In Sync mode the next message is taken only after the previous one was acknowledged.
+		next := send.next()
+		control := c.control
+		if options.Sync && c.outbox.size() > 0 {
+			next, control = make(lanes, priorityLevels), nil
+		}
+		// With flow control the next message is taken only when the peer is ready for it.
+		if options.FlowControl && credits <= 0 {
+			next, control = make(lanes, priorityLevels), nil
+		}
+
 		select {
-		case message, ok := <-send:
-			// Check if the send channel is closed.
-			if !ok {
-				log.Println("Exiting due to SEND channel closed.")
+		case message, ok := <-next[PriorityCritical]:
+			if sendingErr := transmit(message, ok, int(PriorityCritical)); sendingErr != nil {
+				reason = sendingErr
+				return
+			}
+
+		case message, ok := <-next[PriorityHigh]:
+			if sendingErr := transmit(message, ok, int(PriorityHigh)); sendingErr != nil {
+				reason = sendingErr
+				return
+			}
+
+		case message, ok := <-next[PriorityNormal]:
+			if sendingErr := transmit(message, ok, int(PriorityNormal)); sendingErr != nil {
+				reason = sendingErr
 				return
 			}
 
-			// Attempt to encode and send the message.
-			sendingErr := encoder.Encode(message)
+		case message := <-control:
+			if sendingErr := transmit(message, true, 0); sendingErr != nil {
+				reason = sendingErr
+				return
+			}
+
+		case <-added:
+			// Message was queued, send it.
+			if sendingErr := flush(); sendingErr != nil {
+				reason = sendingErr
+				return
+			}
+
+		case <-acked:
+			// Peer took a message, check if the next one can be sent.
+			if c.queued {
+				if sendingErr := flush(); sendingErr != nil {
+					reason = sendingErr
+					return
+				}
+			}
+
+		case n := <-granted:
+			// Peer is ready for n more messages.
+			credits += int64(n)
+			if c.queued {
+				if sendingErr := flush(); sendingErr != nil {
+					reason = sendingErr
+					return
+				}
+			}
+
+		case n := <-grants:
+			// Application took n messages, the peer may send as many more.
+			sendingErr := encoder.Encode(Message{Kind: KindCredit, ID: n})
+			if sendingErr != nil {
+				reason = sendingErr
+				return
+			}
+
+		case id := <-acks:
+			// Confirm delivery of a received message.
+			sendingErr := encoder.Encode(Message{Kind: KindAck, ID: id})
 			if sendingErr != nil {
-				// Re-queue the message on failure and log the error.
-				send <- message
-				log.Printf("Re-queue sending data as sending failed with error: %s\n", sendingErr)
+				reason = sendingErr
 				return
 			}
-			// Logging the sent message is disabled to reduce verbosity.
 
 		case decodeError := <-decodeErrorChannel:
 			// Log any network error received and exit the loop.
 			log.Printf("Netchan handle connection worker exited due to decode error: %s\n", decodeError)
+			reason = decodeError
+			return
+
+		case <-done:
+			// Owner of the connection asked us to shut down.
+			reason = ErrClosed
 			return
 		}
 	}
 }
+
+// forget tells dedupe and reorder that a message was not delivered after all.
+func (c connection) forget(msg Message) {
+	if msg.ID != 0 && c.dedupe != nil {
+		c.dedupe.forget(msg.Origin, msg.ID)
+	}
+	if msg.Seq != 0 && c.reorder != nil {
+		c.reorder.undo(msg)
+	}
+}
+
+// isDecodeError reports whether err is caused by malformed data rather than by the network connection itself.
+// It is used for encoding errors as well.
+func isDecodeError(err error) bool {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed), errors.As(err, &netErr):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+package netchan
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlowControl(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{FlowControl: true, CreditWindow: 5, ReceiveBufferSize: 1})
+	client := startClient(t, ctx, server.Addr().String(), Options{FlowControl: true, CreditWindow: 5, Reliable: true})
+	var sent atomic.Int64
+	go func() {
+		for i := 1; i <= 50; i++ {
+			client.Send() <- Message{Payload: i}
+			sent.Add(1)
+		}
+	}()
+	// Nobody reads on the server, so the client stops after its credits and a few buffered messages.
+	time.Sleep(500 * time.Millisecond)
+	if n := sent.Load(); n > 15 {
+		t.Fatal("sender not throttled", n)
+	}
+	for want := 1; want <= 50; want++ {
+		if v := receivePayload(t, server.Receive()); v != want {
+			t.Fatal(want, v)
+		}
+	}
+
+	// The server is throttled by the client the same way.
+	client.Send() <- Message{Payload: 0}
+	from := receive(t, server.Receive()).From
+	go func() {
+		for i := 0; i < 30; i++ {
+			server.Send() <- Message{To: from, Payload: i}
+		}
+	}()
+	for want := 0; want < 30; want++ {
+		if v := receivePayload(t, client.Receive()); v != want {
+			t.Fatal(want, v)
+		}
+	}
+}
+
+func TestSyncKeepsOneMessageInFlight(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{Sync: true})
+	client := startClient(t, ctx, server.Addr().String(), Options{Sync: true})
+	client.Send() <- Message{Payload: 1}
+	second := make(chan struct{})
+	go func() {
+		client.Send() <- Message{Payload: 2}
+		close(second)
+	}()
+	select {
+	case <-second:
+		t.Fatal("second message taken before the first was acknowledged")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if v := receivePayload(t, server.Receive()); v != 1 {
+		t.Fatal(v)
+	}
+	select {
+	case <-second:
+	case <-time.After(testTimeout):
+		t.Fatal("second message not taken after the first was acknowledged")
+	}
+	if v := receivePayload(t, server.Receive()); v != 2 {
+		t.Fatal(v)
+	}
+}
+
+func TestSyncDispatcherRendezvous(t *testing.T) {
+	ctx := testContext(t)
+	addr := freeAddr(t)
+	serverSend, serverReceive, err := ListenWithOptions(ctx, addr, Options{Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSend, clientReceive, err := DialWithOptions(ctx, addr, Options{Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	take := func(ch chan interface{}) func() int {
+		return func() int {
+			select {
+			case v := <-ch:
+				return v.(int)
+			case <-time.After(testTimeout):
+				t.Fatal("no value")
+			}
+			return 0
+		}
+	}
+	checkRendezvous(t, func(v int) { clientSend <- v }, take(serverReceive))
+	// The client sent three messages, so the server may send it three values.
+	checkRendezvous(t, func(v int) { serverSend <- v }, take(clientReceive))
+}
+
+func TestSyncTypedRendezvous(t *testing.T) {
+	ctx := testContext(t)
+	addr := freeAddr(t)
+	serverSend, serverReceive, _, err := ListenTyped[int](ctx, addr, Options{Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSend, clientReceive, _, err := DialTyped[int](ctx, addr, Options{Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	take := func(ch <-chan int) func() int {
+		return func() int {
+			select {
+			case v := <-ch:
+				return v
+			case <-time.After(testTimeout):
+				t.Fatal("no value")
+			}
+			return 0
+		}
+	}
+	checkRendezvous(t, func(v int) { clientSend <- v }, take(serverReceive))
+	checkRendezvous(t, func(v int) { serverSend <- v }, take(clientReceive))
+}
+
+// checkRendezvous sends 1 and 2 with send and checks that the second send waits until take returned the first value.
+func checkRendezvous(t *testing.T, send func(int), take func() int) {
+	t.Helper()
+	send(1)
+	second := make(chan struct{})
+	go func() {
+		send(2)
+		close(second)
+	}()
+	select {
+	case <-second:
+		t.Fatal("second value taken before the peer application received the first")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if v := take(); v != 1 {
+		t.Fatal(v)
+	}
+	select {
+	case <-second:
+	case <-time.After(testTimeout):
+		t.Fatal("second value not taken after the peer application received the first")
+	}
+	if v := take(); v != 2 {
+		t.Fatal(v)
+	}
+}
@@ -0,0 +1,165 @@
+package netchan
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// The hello is the first line a client writes after the TLS handshake, before any codec data:
+// helloPrefix followed by the peer ID and a newline. The server answers with the welcome line,
+// welcomeOK or welcomeRejected followed by the reason. Both are plain text, so the codec streams
+// start fresh afterwards.
+const (
+	helloPrefix     = "NETCHAN "
+	welcomeOK       = "OK"
+	welcomeRejected = "ERR "
+)
+
+// maxPeerIDLength limits the length of a peer ID in bytes.
+const maxPeerIDLength = 256
+
+// checkPeerID returns an error wrapping ErrHandshake if id cannot be used as peer ID.
+func checkPeerID(id string) error {
+	switch {
+	case id == "":
+		return fmt.Errorf("%w: empty peer ID", ErrHandshake)
+	case len(id) > maxPeerIDLength:
+		return fmt.Errorf("%w: peer ID longer than %d bytes", ErrHandshake, maxPeerIDLength)
+	case strings.ContainsAny(id, "\r\n"):
+		return fmt.Errorf("%w: line break in peer ID", ErrHandshake)
+	case id == BroadcastAddress:
+		return fmt.Errorf("%w: peer ID %q is reserved", ErrHandshake, id)
+	}
+	return nil
+}
+
+// newPeerID returns the peer ID of a client: Options.PeerID if set, otherwise derived from
+// the public key of Options.ClientCertificate, otherwise a random one.
+func newPeerID(options Options) (string, error) {
+	if options.PeerID != "" {
+		return options.PeerID, checkPeerID(options.PeerID)
+	}
+	if options.ClientCertificate != nil && len(options.ClientCertificate.Certificate) > 0 {
+		cert, err := x509.ParseCertificate(options.ClientCertificate.Certificate[0])
+		if err != nil {
+			return "", err
+		}
+		return certificatePeerID(cert)
+	}
+	return newOrigin()
+}
+
+// certificatePeerID derives a peer ID from the public key of cert.
+func certificatePeerID(cert *x509.Certificate) (string, error) {
+	key, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// verifiedPeerID returns the peer ID derived from the certificate the client presented
+// in the TLS handshake of conn, which must be complete.
+func verifiedPeerID(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", fmt.Errorf("not a TLS connection")
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", fmt.Errorf("no client certificate")
+	}
+	return certificatePeerID(certs[0])
+}
+
+// requireClientCertificate returns a copy of config which requires a client certificate,
+// verified against ClientCAs if they are set.
+func requireClientCertificate(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	if config.ClientCAs != nil {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		config.ClientAuth = tls.RequireAnyClientCert
+	}
+	return config
+}
+
+// writeHello sends the peer ID to the server, limited by timeout.
+func writeHello(conn net.Conn, id string, timeout time.Duration) error {
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer conn.SetWriteDeadline(time.Time{})
+
+	if _, err := conn.Write([]byte(helloPrefix + id + "\n")); err != nil {
+		return fmt.Errorf("%w: %s", ErrHandshake, err)
+	}
+	return nil
+}
+
+// readHello reads the peer ID sent by writeHello, limited by timeout.
+func readHello(conn net.Conn, timeout time.Duration) (string, error) {
+	line, err := readLine(conn, len(helloPrefix)+maxPeerIDLength, timeout)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, helloPrefix) {
+		return "", fmt.Errorf("%w: unexpected greeting", ErrHandshake)
+	}
+	id := strings.TrimPrefix(line, helloPrefix)
+	return id, checkPeerID(id)
+}
+
+// writeWelcome accepts the hello of a client, or rejects it with reason if that is not empty.
+// It is limited by timeout.
+func writeWelcome(conn net.Conn, reason string, timeout time.Duration) error {
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer conn.SetWriteDeadline(time.Time{})
+
+	line := welcomeOK
+	if reason != "" {
+		line = welcomeRejected + strings.ReplaceAll(reason, "\n", " ")
+	}
+	_, err := conn.Write([]byte(line + "\n"))
+	return err
+}
+
+// readWelcome reads the answer to the hello, limited by timeout. A rejection is returned
+// as error wrapping ErrHandshake with the reason given by the server.
+func readWelcome(conn net.Conn, timeout time.Duration) error {
+	line, err := readLine(conn, len(welcomeRejected)+maxPeerIDLength+100, timeout)
+	switch {
+	case err != nil:
+		return err
+	case line == welcomeOK:
+		return nil
+	case strings.HasPrefix(line, welcomeRejected):
+		return fmt.Errorf("%w: rejected by server: %s", ErrHandshake, strings.TrimPrefix(line, welcomeRejected))
+	}
+	return fmt.Errorf("%w: unexpected welcome", ErrHandshake)
+}
+
+// readLine reads a line of at most limit bytes without the newline, limited by timeout.
+// It reads byte by byte, so nothing after the line is consumed.
+func readLine(conn net.Conn, limit int, timeout time.Duration) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	line := make([]byte, 0, 64)
+	b := make([]byte, 1)
+	for len(line) <= limit {
+		if _, err := conn.Read(b); err != nil {
+			return "", fmt.Errorf("%w: %s", ErrHandshake, err)
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("%w: line too long", ErrHandshake)
+}
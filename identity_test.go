@@ -0,0 +1,158 @@
+package netchan
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckPeerID(t *testing.T) {
+	for _, id := range []string{"worker-1", "a b", "node.eu/7"} {
+		if err := checkPeerID(id); err != nil {
+			t.Fatal(id, err)
+		}
+	}
+	for _, id := range []string{"", BroadcastAddress, "a\nb", "a\rb", strings.Repeat("x", maxPeerIDLength+1)} {
+		if err := checkPeerID(id); err == nil {
+			t.Fatalf("%q accepted", id)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{})
+	addr := server.Addr().String()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := writeHello(conn, "raw", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := readWelcome(conn, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second connection with the same peer ID is rejected with a reason.
+	duplicate, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer duplicate.Close()
+	if err := writeHello(duplicate, "raw", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := readWelcome(duplicate, time.Second); !errors.Is(err, ErrHandshake) {
+		t.Fatal(err)
+	}
+
+	// A connection which sends no hello is not accepted.
+	silent, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	if _, err := silent.Write([]byte("garbage\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := readWelcome(silent, time.Second); err == nil {
+		t.Fatal("accepted without hello")
+	}
+}
+
+func TestPeerID(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{})
+	addr := server.Addr().String()
+	options := Options{PeerID: "worker-1"}
+
+	client := startClient(t, ctx, addr, options)
+	client.Send() <- Message{Payload: 1}
+	if m := receive(t, server.Receive()); m.From != "worker-1" {
+		t.Fatal(m)
+	}
+	client.Close()
+
+	// The peer ID stays the same across clients.
+	client = startClient(t, ctx, addr, options)
+	time.Sleep(200 * time.Millisecond)
+	server.Send() <- Message{To: "worker-1", Payload: 2}
+	if v := receivePayload(t, client.Receive()); v != 2 {
+		t.Fatal(v)
+	}
+
+	// A duplicate is rejected and the first connection keeps the ID.
+	_, err := NewClientWithOptions(ctx, addr, Options{PeerID: "worker-1", InitialConnectTimeout: 1500 * time.Millisecond})
+	if !errors.Is(err, ErrHandshake) {
+		t.Fatal(err)
+	}
+	server.Send() <- Message{To: "worker-1", Payload: 3}
+	if v := receivePayload(t, client.Receive()); v != 3 {
+		t.Fatal(v)
+	}
+
+	if _, err := NewClientWithOptions(ctx, addr, Options{PeerID: "*"}); !errors.Is(err, ErrHandshake) {
+		t.Fatal(err)
+	}
+	if id := startClient(t, ctx, addr, Options{}).ID(); len(id) != 32 {
+		t.Fatal(id)
+	}
+}
+
+func TestPeerIDFromCertificate(t *testing.T) {
+	cert, err := NewClientCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := newPeerID(Options{ClientCertificate: &cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newPeerID(Options{ClientCertificate: &cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || len(first) != 32 {
+		t.Fatal(first, second)
+	}
+}
+
+func TestVerifyPeerID(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{VerifyPeerID: true})
+	addr := server.Addr().String()
+	cert, err := NewClientCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := startClient(t, ctx, addr, Options{ClientCertificate: &cert})
+	client.Send() <- Message{Payload: 1}
+	if m := receive(t, server.Receive()); m.From != client.ID() {
+		t.Fatal(m, client.ID())
+	}
+
+	// Without a certificate.
+	_, err = NewClientWithOptions(ctx, addr, Options{InitialConnectTimeout: 1500 * time.Millisecond})
+	if !errors.Is(err, ErrHandshake) && !errors.Is(err, ErrTLSHandshake) {
+		t.Fatal(err)
+	}
+	// Claiming the ID of another certificate.
+	other, err := NewClientCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewClientWithOptions(ctx, addr, Options{PeerID: client.ID(), ClientCertificate: &other, InitialConnectTimeout: 1500 * time.Millisecond})
+	if !errors.Is(err, ErrHandshake) {
+		t.Fatal(err)
+	}
+
+	server.Send() <- Message{To: client.ID(), Payload: 2}
+	if v := receivePayload(t, client.Receive()); v != 2 {
+		t.Fatal(v)
+	}
+}
@@ -1,42 +1,157 @@
 package netchan
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"net"
+	"sort"
+	"sync"
 	"time"
 )
 
-// accessLock is a channel used to control access to address book map (one at a time).
-var accessLock chan int
+// Server is a single netchan listener instance.
+// Every Server owns its address book and access lock, so several servers
+// can listen on different addresses inside one process without interfering.
+type Server struct {
+	addr string
 
-// Map for fast searching of connected client addresses and their send channels.
-var addressBookMap map[string]addressBook
+	// send channel for messages from the application to connected clients.
+	sendChan chan Message
+	// receive channel for messages from connected clients to the application.
+	receiveChan chan Message
+	// internalSend carries replies produced by netchan itself to connected clients.
+	internalSend chan Message
+	// appSend carries application messages which do not come from sendChan, for example those of
+	// named channels. They are routed like messages from sendChan, but it is never closed.
+	appSend chan Message
+	// urgent holds the send channels returned by SendPriority, the index is the Priority and
+	// PriorityNormal is sendChan.
+	urgent lanes
+	// urgentOpen is the copy of urgent read by route, which sets a channel to nil after it was closed.
+	urgentOpen lanes
+	// relays carries messages from clients to other clients, see Options.Relay.
+	// They keep From and are dead-lettered like application messages.
+	relays chan Message
+
+	// handler serves calls from clients, nil until Handle is called.
+	handler Handler
+	// handlerLock is a channel used to control access to handler (one at a time).
+	handlerLock chan int
+	// calls maps running calls, keyed by client and CallID, to the cancel function of their context.
+	calls map[string]context.CancelFunc
+	// callsLock is a channel used to control access to calls (one at a time).
+	callsLock chan int
+
+	// listener accepts client connections, it is bound before NewServer returns.
+	listener net.Listener
+
+	// options holds buffer sizes, timeouts, TLS settings, logger and codec of this server.
+	options Options
+	// logOnce writes repeated listen errors to options.Logger only once.
+	logOnce *onceLogger
+
+	// origin identifies messages of this server in reliable and ordered mode,
+	// every client is a stream of its own named origin/peer ID/number.
+	origin string
+	// peers holds the state of every client kept across its reconnects, see peerState.
+	peers map[string]*peerState
+	// streams counts the states created for clients, it numbers their streams.
+	streams uint64
+	// peersLock is a channel used to control access to peers and streams (one at a time).
+	peersLock chan int
+	// dedupe drops retransmitted messages from clients in exactly-once mode, nil otherwise.
+	dedupe *dedupe
+
+	// events delivers connection lifecycle events to the application.
+	events eventStream
+
+	// reorder delivers messages of every client in the order they were sent in ordered mode, nil otherwise.
+	reorder *reorder
+
+	// expiry drops messages whose Expires deadline passed and counts them.
+	expiry *expiry
+
+	// deadLetters delivers messages which could not be delivered to the application.
+	deadLetters deadLetters
+
+	// channels holds the named channels multiplexed over the client connections.
+	channels *channelTable
+
+	// topics holds the subscriptions of connected clients.
+	topics *subscriptions
+
+	// accessLock is a channel used to control access to address book map (one at a time).
+	accessLock chan int
+	// Map for fast searching of connected client addresses and their send channels.
+	addressBookMap map[string]addressBook
+	// sendClosed is set when the application closed the send channel, new clients get a closed send channel.
+	sendClosed bool
+
+	// broadcasts carries Broadcast calls to route.
+	broadcasts chan broadcastRequest
+
+	// members queues address book changes for Options.Balancer, nil without it.
+	members *membership
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// workers counts every goroutine that may write to receiveChan.
+	workers sync.WaitGroup
+	// stopped is closed after all workers exited and receiveChan was closed.
+	stopped chan struct{}
+}
 
 // Coordinator handles all addressBookMap operations.
-func addressBookManager(operation string, clientAddress string, clientSendChannel chan Message) chan Message {
+func (s *Server) addressBookManager(operation string, clientAddress string, entry addressBook) lanes {
 
 	// Lock access to address book
-	accessLock <- 1
+	s.accessLock <- 1
 
 	defer func() {
-		<-accessLock
+		<-s.accessLock
 		// Unlock access to address book
 		//NOTE: defer func() goes reverse direction!
 	}()
 
 	switch operation {
 	case "add":
-		// Adding connected client to the address book.
-		addressBookMap[clientAddress] = addressBook{Send: clientSendChannel}
+		// Adding connected client to the address book unless its address is taken,
+		// the lanes of the connection holding it are returned then.
+		if current, taken := s.addressBookMap[clientAddress]; taken {
+			return current.Send
+		}
+		s.addressBookMap[clientAddress] = entry
+		s.members.push(clientAddress, true)
+		if s.sendClosed {
+			// Server will never send anything, tell the client right away.
+			entry.Send.close()
+		}
 		return nil
-	case "delete":
-		// Removing disconnected client from the address book.
-		delete(addressBookMap, clientAddress)
+	case "close":
+		// Closing send channels of all clients, their connections send a close frame.
+		s.sendClosed = true
+		for _, addressbook := range s.addressBookMap {
+			addressbook.Send.close()
+		}
 		return nil
+	case "delete":
+		// Removing disconnected client from the address book, its lanes are returned.
+		addressbook, ok := s.addressBookMap[clientAddress]
+		if ok {
+			delete(s.addressBookMap, clientAddress)
+			s.members.push(clientAddress, false)
+		}
+		return addressbook.Send
 	case "get":
-		// Return client send channel
-		addressbook, ok := addressBookMap[clientAddress]
+		if s.sendClosed {
+			// Send channels of all clients are closed.
+			return nil
+		}
+		// Return client send lanes
+		addressbook, ok := s.addressBookMap[clientAddress]
 		if ok {
 			return addressbook.Send
 		} else {
@@ -47,147 +162,729 @@ func addressBookManager(operation string, clientAddress string, clientSendChanne
 	return nil
 }
 
-// AdvancedListen sets up a secure TCP listener using TLS.
-// It returns two channels for sending and receiving messages in special netchan type, along with an error.
-// addr: The network address to listen on.
-func AdvancedListen(addr string) (sendChan chan Message, receiveChan chan Message, err error) {
-	// send channel with 1 message queue length.
-	sendChan = make(chan Message, 1)
-	receiveChan = make(chan Message, 1000)
+// addressBookSnapshot returns the addresses of all connected clients, sorted.
+// closed is set when the application closed the send channel.
+func (s *Server) addressBookSnapshot() (addresses []string, closed bool) {
+	s.accessLock <- 1
+	defer func() { <-s.accessLock }()
 
-	// A channel to signal successful connection
-	serverBindedOnPort := make(chan bool)
+	for address := range s.addressBookMap {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses, s.sendClosed
+}
 
-	// Map for fast searching of connected client addresses and their send channels.
-	addressBookMap = make(map[string]addressBook)
+// NewServer sets up a secure TCP listener using TLS and returns a Server handle once the port is bound.
+// An error wrapping ErrBind is returned when the address is busy or invalid,
+// see Options.ListenRetry to keep trying instead.
+// The server stops when ctx is canceled or Close is called:
+// the TLS listener and every client connection are closed, all internal goroutines exit
+// and the receive channel is closed after the last message has been delivered to it.
+func NewServer(ctx context.Context, addr string) (*Server, error) {
+	return NewServerWithOptions(ctx, addr, DefaultOptions())
+}
+
+// NewServerWithOptions works like NewServer, but uses the given options instead of the defaults.
+func NewServerWithOptions(ctx context.Context, addr string, options Options) (*Server, error) {
+	options = options.withDefaults()
+	ctx, cancel := context.WithCancel(ctx)
 
-	// access lock to address book:
-	accessLock = make(chan int, 1)
+	s := &Server{
+		addr:           addr,
+		options:        options,
+		logOnce:        newOnceLogger(options.Logger),
+		sendChan:       make(chan Message, options.sendBufferSize()),
+		receiveChan:    make(chan Message, options.receiveBufferSize()),
+		internalSend:   make(chan Message, options.SendBufferSize),
+		appSend:        make(chan Message, options.SendBufferSize),
+		relays:         make(chan Message, options.SendBufferSize),
+		handlerLock:    make(chan int, 1),
+		calls:          make(map[string]context.CancelFunc),
+		callsLock:      make(chan int, 1),
+		events:         make(eventStream, options.EventBufferSize),
+		deadLetters:    make(deadLetters, options.DeadLetterBufferSize),
+		accessLock:     make(chan int, 1),
+		addressBookMap: make(map[string]addressBook),
+		peers:          make(map[string]*peerState),
+		peersLock:      make(chan int, 1),
+		broadcasts:     make(chan broadcastRequest),
+		ctx:            ctx,
+		cancel:         cancel,
+		stopped:        make(chan struct{}),
+	}
+	s.expiry = &expiry{events: s.events, dead: s.deadLetters}
+	s.channels = newChannelTable(ctx, s.appSend, false, options)
+	s.urgent = newLanes(options.sendBufferSize())
+	s.urgent[PriorityNormal] = s.sendChan
+	s.urgentOpen = append(lanes(nil), s.urgent...)
+	s.topics = newSubscriptions()
+	if options.Ordered {
+		s.reorder = newReorder(options.ReorderBufferSize)
+	}
+	if options.Balancer != nil {
+		s.members = newMembership()
+	}
 
 	// Generate TLS configuration for secure communication.
-	tlsConfig, err := generateTLSConfig()
+	tlsConfig, err := options.tlsConfig()
 	if err != nil {
-		return
+		cancel()
+		return nil, err
+	}
+	if options.VerifyPeerID {
+		tlsConfig = requireClientCertificate(tlsConfig)
+	}
+
+	// origin identifies messages of this server in reliable mode.
+	s.origin, err = newOrigin()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if options.ExactlyOnce {
+		s.dedupe, err = newDedupe(options)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	// Bind the port before returning, so the caller learns about busy or invalid addresses.
+	s.listener, err = s.bind(tlsConfig)
+	if err != nil {
+		cancel()
+		return nil, err
 	}
 
 	// Goroutine to handle incoming connections from clients and message routing.
+	s.workers.Add(1)
+	go s.run()
+
+	if s.dedupe != nil {
+		// Goroutine saving delivered message IDs, the last save happens on shutdown.
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			s.dedupe.run(ctx, time.Second, options.Logger)
+		}()
+	}
+
+	// Close receive channel once nobody can write to it anymore.
 	go func() {
-		for {
-			listener, err := tls.Listen("tcp", addr, tlsConfig)
-			if err != nil {
-				Printonce(fmt.Sprintf("TLS listen error: %s", err))
-			  //close the listener if it was not started correctly:
-        listener.Close()
-				// Retry to listen in 5 seconds interval.
-				time.Sleep(time.Second * 5)
-				continue
-			} else {
-				defer listener.Close()
-
-				// If connection is successful, send a signal
-				serverBindedOnPort <- true
-
-				go func() {
-					for {
-						select {
-						case message := <-sendChan:
-							// Forwarding messages to the appropriate recipient.
-							clientReceiveChannel := addressBookManager("get", message.To, nil)
-							if clientReceiveChannel == nil {
-								// If recipient not found, return message to sender.
-								log.Printf("Address %s not found in addressbook, returning message back sender via RECEIVE channel.", message.To)
-								receiveChan <- message
-							} else {
-								clientReceiveChannel <- message
-							}
-						}
-					}
-				}()
+		s.workers.Wait()
+		close(s.receiveChan)
+		s.channels.closeAll()
+		close(s.events)
+		close(s.deadLetters)
+		close(s.stopped)
+	}()
 
-				log.Printf("Listening on %s\n", addr)
+	return s, nil
+}
 
-				clientDisconnectNotifyChan := make(chan string, 100000)
+// bind opens the TLS listener. Without Options.ListenRetry the first error is returned,
+// otherwise binding is retried with exponential backoff until it succeeds,
+// ListenRetryAttempts are used up or the server is stopped.
+func (s *Server) bind(tlsConfig *tls.Config) (net.Listener, error) {
+	delay := s.options.ListenRetryDelay
+	for attempt := 1; ; attempt++ {
+		listener, err := tls.Listen("tcp", s.addr, tlsConfig)
+		if err == nil {
+			return listener, nil
+		}
+		err = fmt.Errorf("%w: %s", ErrBind, err)
+		if !s.options.ListenRetry || (s.options.ListenRetryAttempts > 0 && attempt >= s.options.ListenRetryAttempts) {
+			return nil, err
+		}
+		s.logOnce.printonce(fmt.Sprintf("TLS listen error: %s, retrying in %s", err, delay))
+		select {
+		case <-time.After(delay):
+		case <-s.ctx.Done():
+			return nil, s.ctx.Err()
+		}
+		delay *= 2
+		if delay > s.options.ListenRetryMaxDelay {
+			delay = s.options.ListenRetryMaxDelay
+		}
+	}
+}
 
-				go func() {
-					for {
-						select {
-						case address := <-clientDisconnectNotifyChan:
-							// Removing disconnected clients from the address book.
-							addressBookManager("delete", address, nil)
-							log.Printf("Connection closed and removed from address book: %s", address)
-						}
-					}
-				}()
+// Send returns the channel for messages to connected clients, addressed by Message.To.
+// It belongs to the caller and is never closed by netchan. Closing it sends a close frame
+// to every client, so their receive channels are closed after draining.
+func (s *Server) Send() chan Message {
+	return s.sendChan
+}
 
-				for {
-					conn, err := listener.Accept()
-					if err != nil {
-						log.Printf("Failed to accept connection: %v", err)
-						continue
-					}
+// SendPriority returns the channel for messages to connected clients with priority p, addressed by Message.To.
+// Messages sent on it get priority p. Unlike messages with that Priority on Send, they do not wait
+// behind messages of lower priorities which the server cannot hand to a slow client yet.
+// PriorityNormal returns Send. After Send was closed, messages end up in DeadLetters with ErrClosed.
+func (s *Server) SendPriority(p Priority) chan Message {
+	return s.urgent.lane(p)
+}
+
+// Receive returns the channel with messages from connected clients.
+// A client that closed its send channel is reported by a message with Kind KindClose.
+// It is closed when the server stops.
+func (s *Server) Receive() chan Message {
+	return s.receiveChan
+}
+
+// OpenChannel returns the named channel name, it is created on first use.
+// Messages sent on it are addressed by Message.To and reach the channel with the same name
+// opened by that client. Received messages come from any client which uses this name,
+// a client that closed its side is reported by a message with Kind KindClose.
+// Messages for a name which was not opened end up in DeadLetters with ErrUnknownChannel,
+// and an opened channel must be read, otherwise it blocks the connections delivering to it.
+// The empty name returns the main channel of Send and Receive. After Send was closed,
+// messages of named channels end up in DeadLetters with ErrClosed.
+func (s *Server) OpenChannel(name string) *Channel {
+	if name == "" {
+		return &Channel{send: s.sendChan, receive: s.receiveChan}
+	}
+	return s.channels.open(name)
+}
+
+// Events returns the channel with connection lifecycle events of this server.
+// Events are dropped when the channel is full. It is closed when the server stops.
+func (s *Server) Events() <-chan Event {
+	return s.events
+}
+
+// DeadLetters returns the channel with messages this server could not deliver and the reason.
+// Messages to unknown recipients, expired messages and messages still waiting for a client
+// when it disconnected end up here. Dead letters are dropped when the channel is full.
+// It is closed when the server stops.
+func (s *Server) DeadLetters() <-chan DeadLetter {
+	return s.deadLetters
+}
+
+// Expired returns the number of messages this server dropped because their Expires deadline passed.
+func (s *Server) Expired() uint64 {
+	return s.expiry.total()
+}
 
-					sendToClientChan := make(chan Message, 1)
-					clientAddress := conn.RemoteAddr().String()
+// Addr returns the address the server is listening on.
+// It is useful with port 0, when the system picks a free port.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops the server and waits until all its goroutines exited.
+func (s *Server) Close() error {
+	s.cancel()
+	<-s.stopped
+	return nil
+}
+
+// run routes outgoing messages and accepts client connections until the server stops.
+func (s *Server) run() {
+	defer s.workers.Done()
+
+	log := s.options.Logger
+	listener := s.listener
+
+	// Close the listener on shutdown, this unblocks Accept below.
+	go func() {
+		<-s.ctx.Done()
+		listener.Close()
+	}()
+
+	s.events.emit(ListenerBound, listener.Addr().String(), nil)
+
+	s.workers.Add(1)
+	go s.route()
+
+	log.Printf("Listening on %s\n", listener.Addr())
+	if s.options.Relay != nil && !s.options.VerifyPeerID {
+		log.Printf("Relay is enabled without VerifyPeerID: peer IDs are not verified, clients can relay as any other client")
+	}
 
-					// Registering new client in the address book with channels that we can connect them through.
-					addressBookManager("add", clientAddress, sendToClientChan)
+	clientDisconnectNotifyChan := make(chan peerDisconnect, s.options.DisconnectQueueSize)
 
-					// Handle individual client connection.
-					go handleConnection(conn, sendToClientChan, receiveChan, clientDisconnectNotifyChan)
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		// Messages kept for clients which do not come back end up in DeadLetters.
+		interval := s.options.PeerRetention / 2
+		if interval < time.Millisecond {
+			// A tiny retention cannot be swept more often than that.
+			interval = time.Millisecond
+		}
+		sweep := time.NewTicker(interval)
+		defer sweep.Stop()
+		for {
+			select {
+			case now := <-sweep.C:
+				for peer, state := range s.expirePeers(now, false) {
+					s.forgetPeer(peer, state)
 				}
+			case disconnected := <-clientDisconnectNotifyChan:
+				// Removing disconnected clients from the address book.
+				clientSendLanes := s.addressBookManager("delete", disconnected.Address, addressBook{})
+				s.topics.drop(disconnected.Address)
+				// Messages still waiting for the client will never be sent.
+				s.bounce(clientSendLanes, disconnected.Address)
+				log.Printf("Connection closed and removed from address book: %s", disconnected.Address)
+				s.events.emit(PeerDisconnected, disconnected.Address, disconnected.Reason)
+			case <-s.ctx.Done():
+				// Connected clients are forgotten when their connection ends.
+				for peer, state := range s.expirePeers(time.Time{}, true) {
+					s.forgetPeer(peer, state)
+				}
+				return
 			}
 		}
 	}()
 
-	// Wait for a successful connection signal
-	<-serverBindedOnPort
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				// Listener was closed on shutdown.
+				log.Printf("Stopped listening on %s", s.addr)
+				return
+			}
+			log.Printf("Failed to accept connection: %v", err)
+			continue
+		}
 
-	return sendChan, receiveChan, nil
+		// Handle individual client connection.
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+
+			// The client tells its peer ID first, it is the address of the client from now on.
+			handshakeDone := make(chan struct{})
+			go func() {
+				// Do not wait for a silent client on shutdown.
+				select {
+				case <-s.ctx.Done():
+					conn.Close()
+				case <-handshakeDone:
+				}
+			}()
+			clientAddress, err := readHello(conn, s.options.DialTimeout)
+			close(handshakeDone)
+			if err != nil {
+				log.Printf("Handshake with %s failed: %s", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			// reject tells the client why it cannot connect.
+			reject := func(reason string) {
+				log.Printf("Handshake with %s failed: %s", conn.RemoteAddr(), reason)
+				writeWelcome(conn, reason, s.options.DialTimeout)
+				conn.Close()
+			}
+			if s.options.VerifyPeerID {
+				verified, err := verifiedPeerID(conn)
+				if err != nil {
+					reject(err.Error())
+					return
+				}
+				if verified != clientAddress {
+					reject(fmt.Sprintf("peer ID %q does not match the client certificate", clientAddress))
+					return
+				}
+			}
+
+			sendToClientChan := newLanes(s.options.sendBufferSize())
+
+			// Registering new client in the address book with channels that we can connect them through.
+			// Another connection with the same peer ID is not evicted, the new one is rejected instead.
+			if taken := s.addressBookManager("add", clientAddress, addressBook{Send: sendToClientChan}); taken != nil {
+				reject(fmt.Sprintf("peer ID %q is in use", clientAddress))
+				return
+			}
+			// A failed write is noticed by handleConnection like any other.
+			writeWelcome(conn, "", s.options.DialTimeout)
+			s.events.emit(PeerConnected, clientAddress, nil)
+
+			// Unacknowledged and failed messages of a previous connection are sent again on this one.
+			state := s.acquirePeer(clientAddress)
+			handleConnection(connection{
+				conn:             conn,
+				peerID:           clientAddress,
+				send:             sendToClientChan,
+				receive:          s.receiveChan,
+				disconnectNotify: clientDisconnectNotifyChan,
+				done:             s.ctx.Done(),
+				options:          s.options,
+				events:           s.events,
+				outbox:           state.outbox,
+				dedupe:           s.dedupe,
+				expiry:           s.expiry,
+				retry:            state.retry,
+				deadLetters:      s.deadLetters,
+				sequence:         state.sequence,
+				reorder:          s.reorder,
+				intercept:        s.intercept,
+				channels:         s.channels,
+			})
+			// The state waits for the client to reconnect, unless the server stops.
+			if forgotten := s.releasePeer(clientAddress); forgotten != nil {
+				s.forgetPeer(clientAddress, forgotten)
+			}
+		}()
+	}
+}
+
+// bounce hands the messages waiting in the lanes of a gone connection of client to DeadLetters.
+func (s *Server) bounce(clientSendLanes lanes, client string) {
+	for _, message := range clientSendLanes.drain() {
+		if !s.expiry.check(message, client) {
+			s.deadLetters.put(message, ErrPeerDisconnected)
+		}
+	}
+}
+
+// route forwards messages from the application, relayed messages and internal replies to connected clients.
+// It is the only writer to client send channels, so it can close them safely.
+func (s *Server) route() {
+	defer s.workers.Done()
+
+	sendChan := s.sendChan
+
+	for {
+		var message Message
+		var ok, internal, relayed bool
+		select {
+		case message, ok = <-sendChan:
+			if !ok {
+				// Application closed the send channel, propagate it to every client.
+				s.addressBookManager("close", "", addressBook{})
+				// Internal replies are dropped from now on, keep draining them.
+				sendChan = nil
+				continue
+			}
+			message = s.fromApplication(message)
+		case message, ok = <-s.urgentOpen[PriorityHigh]:
+			if message, ok = s.takeUrgent(PriorityHigh, message, ok, sendChan == nil); !ok {
+				continue
+			}
+		case message, ok = <-s.urgentOpen[PriorityCritical]:
+			if message, ok = s.takeUrgent(PriorityCritical, message, ok, sendChan == nil); !ok {
+				continue
+			}
+		case message = <-s.appSend:
+			if sendChan == nil {
+				// Client send channels were closed with the main send channel.
+				s.deadLetters.put(message, ErrClosed)
+				continue
+			}
+			message = s.fromApplication(message)
+		case message = <-s.relays:
+			if sendChan == nil {
+				s.deadLetters.put(message, ErrClosed)
+				continue
+			}
+			relayed = true
+		case message = <-s.internalSend:
+			internal = true
+		case request := <-s.broadcasts:
+			result, ok := s.broadcast(request.ctx, request.message)
+			if !ok {
+				return
+			}
+			request.result <- result
+			continue
+		case <-s.ctx.Done():
+			return
+		}
+
+		if !s.forward(message, internal, relayed) {
+			return
+		}
+	}
+}
+
+// fromApplication prepares a message from the application for routing.
+func (s *Server) fromApplication(message Message) Message {
+	message = s.options.stamp(message)
+	// Clients trust From set by the server, it is only kept for relayed and published messages.
+	message.From = ""
+	return message
+}
+
+// takeUrgent prepares message taken from the SendPriority channel of priority p, ok tells whether
+// the channel was open. It returns false if there is nothing to route: the channel was closed and
+// is not read anymore, or the message was dead-lettered because Send was closed before.
+// It is called by route only.
+func (s *Server) takeUrgent(p Priority, message Message, ok bool, sendClosed bool) (Message, bool) {
+	if !ok {
+		s.urgentOpen[p] = nil
+		return message, false
+	}
+	message.Priority = p
+	if sendClosed {
+		s.deadLetters.put(message, ErrClosed)
+		return message, false
+	}
+	return s.fromApplication(message), true
+}
+
+// forward routes message to its client, to every client or to the subscribers of its topic.
+// It returns false when the server stops.
+func (s *Server) forward(message Message, internal bool, relayed bool) bool {
+	log := s.options.Logger
+
+	if message.To == BroadcastAddress {
+		// Every client gets a copy, those which cannot be reached end up in DeadLetters.
+		result, ok := s.broadcast(s.ctx, message)
+		if !ok {
+			return false
+		}
+		for address, reason := range result.failed {
+			message.To = address
+			s.deadLetters.put(message, reason)
+		}
+		return true
+	}
+
+	// Stale messages are dropped instead of being queued for a slow client.
+	if s.expiry.check(message, message.To) {
+		return true
+	}
+
+	if message.Topic != "" && message.To == "" {
+		// Published message, every subscriber gets a copy.
+		return s.publish(message)
+	}
+
+	// Forwarding messages to the appropriate recipient.
+	clientSendLanes := s.addressBookManager("get", message.To, addressBook{})
+	if clientSendLanes == nil {
+		if internal {
+			log.Printf("Address %s not found in addressbook, dropping internal message.", message.To)
+			return true
+		}
+		if relayed {
+			// Recipient disconnected after the relay was accepted, the sender's copy is acknowledged already.
+			s.deadLetters.put(message, ErrPeerDisconnected)
+			return true
+		}
+		// If recipient not found, hand the message back to sender via DeadLetters channel.
+		log.Printf("Address %s not found in addressbook, returning message back sender via DEAD LETTERS channel.", message.To)
+		s.deadLetters.put(message, ErrUnknownRecipient)
+		return true
+	}
+	return s.toLane(clientSendLanes, message)
+}
+
+// toLane puts message into the lane of its priority in clientSendLanes. While the lane is full,
+// messages from SendPriority channels of higher priorities are routed first, so they do not wait
+// behind it. It returns false when the server stops.
+func (s *Server) toLane(clientSendLanes lanes, message Message) bool {
+	for {
+		// Only channels of priorities above that of message are read.
+		above := s.urgentOpen.above(message.Priority)
+		var urgent Message
+		var ok bool
+		var p Priority
+		select {
+		case clientSendLanes.lane(message.Priority) <- message:
+			return true
+		case urgent, ok = <-above[PriorityHigh]:
+			p = PriorityHigh
+		case urgent, ok = <-above[PriorityCritical]:
+			p = PriorityCritical
+		case <-s.ctx.Done():
+			return false
+		}
+		// Send was not closed, route closes lanes only after it returned from here.
+		if urgent, ok = s.takeUrgent(p, urgent, ok, false); ok && !s.forward(urgent, false, false) {
+			return false
+		}
+	}
+}
+
+// publish sends message to every client subscribed to its topic. It returns false when the server stops.
+func (s *Server) publish(message Message) bool {
+	for _, subscriber := range s.topics.match(message.Topic) {
+		clientSendLanes := s.addressBookManager("get", subscriber, addressBook{})
+		if clientSendLanes == nil {
+			// Subscriber disconnected in the meantime.
+			continue
+		}
+		message.To = subscriber
+		if !s.toLane(clientSendLanes, message) {
+			return false
+		}
+	}
+	return true
+}
+
+// intercept consumes calls, subscriptions, messages published by clients and relayed messages
+// before they reach the receive channel.
+func (s *Server) intercept(message Message) bool {
+	return s.serveCall(message) || s.serveTopic(message) || s.serveRelay(message)
+}
+
+// AdvancedListen sets up a secure TCP listener using TLS.
+// It returns two channels for sending and receiving messages in special netchan type, along with an error.
+// addr: The network address to listen on.
+func AdvancedListen(addr string) (sendChan chan Message, receiveChan chan Message, err error) {
+	return AdvancedListenContext(context.Background(), addr)
+}
+
+// AdvancedListenContext works like AdvancedListen, but stops when ctx is canceled.
+// See NewServer for shutdown details.
+func AdvancedListenContext(ctx context.Context, addr string) (sendChan chan Message, receiveChan chan Message, err error) {
+	return AdvancedListenWithOptions(ctx, addr, DefaultOptions())
+}
+
+// AdvancedListenWithOptions works like AdvancedListenContext, but uses the given options instead of the defaults.
+func AdvancedListenWithOptions(ctx context.Context, addr string, options Options) (sendChan chan Message, receiveChan chan Message, err error) {
+	s, err := NewServerWithOptions(ctx, addr, options)
+	if err != nil {
+		return
+	}
+	return s.Send(), s.Receive(), nil
 }
 
 // Listen sets up a dispatcher for handling messages between clients and the server.
 // It returns two channels for sending and receiving any data types, along with an error.
 // address: The network address on which the server will listen.
 func Listen(address string) (dispatcherSend chan interface{}, dispatcherReceive chan interface{}, err error) {
-	// send channel with 1 message queue length.
-	dispatcherSend = make(chan interface{}, 1)
-	dispatcherReceive = make(chan interface{}, 1000)
+	return ListenContext(context.Background(), address)
+}
+
+// ListenContext works like Listen, but stops the dispatcher and the underlying listener
+// when ctx is canceled. dispatcherReceive is closed on shutdown.
+// Closing dispatcherSend is propagated to every client.
+func ListenContext(ctx context.Context, address string) (dispatcherSend chan interface{}, dispatcherReceive chan interface{}, err error) {
+	return ListenWithOptions(ctx, address, DefaultOptions())
+}
+
+// ListenWithOptions works like ListenContext, but uses the given options instead of the defaults.
+func ListenWithOptions(ctx context.Context, address string, options Options) (dispatcherSend chan interface{}, dispatcherReceive chan interface{}, err error) {
+	_, dispatcherSend, dispatcherReceive, err = listenDispatcher(ctx, address, options, nil)
+	return
+}
+
+// listenDispatcher implements ListenWithOptions, it also returns the server.
+// In Sync mode the dispatcher holds a value until the client application took it, r is nil or
+// the rendezvous with the layer on top of the returned channels.
+func listenDispatcher(ctx context.Context, address string, options Options, r *rendezvous) (server *Server, dispatcherSend chan interface{}, dispatcherReceive chan interface{}, err error) {
+	options = options.withDefaults()
+	options.dispatched = options.Sync
+	if r == nil {
+		r = &rendezvous{}
+	}
+
+	dispatcherSend = make(chan interface{}, options.sendBufferSize())
+	dispatcherReceive = make(chan interface{}, options.receiveBufferSize())
 
 	// Channel which holds addresses of clients that are ready to receive data.
-	var ReadyClientsAddressList = make(chan string, 10000000)
+	var ReadyClientsAddressList = make(chan string, options.ReadyQueueSize)
 
-	send, receive, err := AdvancedListen(address)
+	server, err = NewServerWithOptions(ctx, address, options)
 	if err != nil {
-		log.Fatal(err)
+		options.Logger.Println(err)
 		return
 	}
+	send, receive := server.Send(), server.Receive()
 
-	// Goroutine for sending messages to ready clients.
+	// Payloads which did not reach their client, they are sent to the next ready client.
+	redispatch := make(chan interface{})
+
+	if options.Balancer != nil {
+		// Goroutine for sending messages to the clients picked by the balancer,
+		// ReadyClientsAddressList tells it which clients replied.
+		go balance(ctx, options, r, dispatcherSend, redispatch, send, server.members, ReadyClientsAddressList)
+	} else {
+		// Goroutine for sending messages to ready clients.
+		go dispatchReady(ctx, options, r, dispatcherSend, redispatch, send, ReadyClientsAddressList)
+	}
+
+	// Goroutine for handing payloads of disconnected clients to other clients.
 	go func() {
-		for {
+		for letter := range server.DeadLetters() {
+			if !errors.Is(letter.Reason, ErrUnknownRecipient) && !errors.Is(letter.Reason, ErrPeerDisconnected) {
+				options.Logger.Printf("Dropping undeliverable message: %s", letter.Reason)
+				continue
+			}
 			select {
-			case payload := <-dispatcherSend:
-				data := Message{}
-				data.Payload = payload
-				data.To = <-ReadyClientsAddressList
-				send <- data
+			case redispatch <- letter.Message.Payload:
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
 
 	// Goroutine for handling received messages and client readiness.
 	go func() {
+		defer close(dispatcherReceive)
 		for {
 			select {
-			case data := <-receive:
-				ReadyClientsAddressList <- data.From
+			case data, ok := <-receive:
+				if !ok {
+					return
+				}
+				if data.Kind == KindClose {
+					// Client will not send anymore, so it will not report readiness either.
+					data.handOver()
+					continue
+				}
+				select {
+				case ReadyClientsAddressList <- data.From:
+				case <-ctx.Done():
+					return
+				}
 				if data.Payload != nil {
 					// Passing the message payload to the server.
-					dispatcherReceive <- data.Payload
+					select {
+					case dispatcherReceive <- data.Payload:
+					case <-ctx.Done():
+						return
+					}
+					// In Sync mode the client waits until the application took the message.
+					if !await(ctx, r.taken) {
+						return
+					}
 				}
+				data.handOver()
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
 
 	return
 }
+
+// dispatchReady hands payloads from dispatcherSend and redispatch to the clients in ready until ctx is done.
+// A client is in ready once for every message it sent, so each payload goes to a client which asked for more.
+// In Sync mode it waits until the client application took a payload and signals r.sent for those of dispatcherSend.
+func dispatchReady(ctx context.Context, options Options, r *rendezvous, dispatcherSend chan interface{}, redispatch chan interface{}, send chan Message, ready chan string) {
+	for {
+		var payload interface{}
+		// sent is the rendezvous signal for the payload, redispatched payloads were signaled before.
+		var sent chan struct{}
+		select {
+		case data, ok := <-dispatcherSend:
+			if !ok {
+				// Propagate close to all clients.
+				close(send)
+				return
+			}
+			payload, sent = data, r.sent
+		case payload = <-redispatch:
+		case <-ctx.Done():
+			return
+		}
+		data := Message{}
+		data.Payload = payload
+		select {
+		case data.To = <-ready:
+		case <-ctx.Done():
+			return
+		}
+		if !dispatch(ctx, send, data, options) || !notify(ctx, sent) {
+			return
+		}
+	}
+}
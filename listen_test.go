@@ -0,0 +1,152 @@
+package netchan
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestTeardownLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := freeAddr(t)
+	serverSend, serverReceive, err := ListenContext(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSend, clientReceive, err := DialContext(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSend <- 42
+	if v := <-serverReceive; v.(int) != 42 {
+		t.Fatal(v)
+	}
+	serverSend <- 7
+	if v := <-clientReceive; v.(int) != 7 {
+		t.Fatal(v)
+	}
+
+	cancel()
+	for range serverReceive {
+	}
+	for range clientReceive {
+	}
+	// Goroutines end shortly after the receive channels are closed.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		buf := make([]byte, 1<<20)
+		n := runtime.Stack(buf, true)
+		t.Fatalf("%d goroutines before, %d after teardown:\n%s", before, after, buf[:n])
+	}
+}
+
+func TestTwoServersInOneProcess(t *testing.T) {
+	ctx := testContext(t)
+	a := startServer(t, ctx, Options{})
+	b := startServer(t, ctx, Options{})
+	clientA := startClient(t, ctx, a.Addr().String(), Options{})
+	clientB := startClient(t, ctx, b.Addr().String(), Options{})
+
+	clientA.Send() <- Message{Payload: 1}
+	clientB.Send() <- Message{Payload: 2}
+	fromA := receive(t, a.Receive())
+	fromB := receive(t, b.Receive())
+	if fromA.Payload.(int) != 1 || fromB.Payload.(int) != 2 {
+		t.Fatal(fromA, fromB)
+	}
+	a.Send() <- Message{To: fromA.From, Payload: 10}
+	b.Send() <- Message{To: fromB.From, Payload: 20}
+	if v := receivePayload(t, clientA.Receive()); v != 10 {
+		t.Fatal(v)
+	}
+	if v := receivePayload(t, clientB.Receive()); v != 20 {
+		t.Fatal(v)
+	}
+}
+
+func TestBindErrors(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{})
+	if _, err := NewServer(ctx, server.Addr().String()); !errors.Is(err, ErrBind) {
+		t.Fatal(err)
+	}
+	if _, err := NewServer(ctx, "nonsense"); !errors.Is(err, ErrBind) {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseSendChannel(t *testing.T) {
+	ctx := testContext(t)
+	addr := freeAddr(t)
+	serverSend, serverReceive, err := ListenContext(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSend, clientReceive, err := DialContext(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSend <- 1
+	<-serverReceive
+	serverSend <- 5
+	close(serverSend)
+	// The client gets the pending payload, then its receive channel is closed.
+	n := 0
+	for v := range clientReceive {
+		if v.(int) != 5 {
+			t.Fatal(v)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Fatal(n)
+	}
+	// The other direction stays open.
+	clientSend <- 2
+	if v := <-serverReceive; v.(int) != 2 {
+		t.Fatal(v)
+	}
+
+	server := startServer(t, ctx, Options{})
+	client := startClient(t, ctx, server.Addr().String(), Options{})
+	client.Send() <- Message{Payload: 1}
+	close(client.Send())
+	if v := receivePayload(t, server.Receive()); v != 1 {
+		t.Fatal(v)
+	}
+	if m := receive(t, server.Receive()); m.Kind != KindClose {
+		t.Fatal(m)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{})
+	client := startClient(t, ctx, server.Addr().String(), Options{})
+	if e := <-server.Events(); e.Type != ListenerBound {
+		t.Fatal(e)
+	}
+	if e := <-server.Events(); e.Type != PeerConnected {
+		t.Fatal(e)
+	}
+	if e := <-client.Events(); e.Type != PeerConnected {
+		t.Fatal(e)
+	}
+	client.Close()
+	if e := <-server.Events(); e.Type != PeerDisconnected {
+		t.Fatal(e)
+	}
+	var last Event
+	for e := range client.Events() {
+		last = e
+	}
+	if last.Type != PeerDisconnected {
+		t.Fatal(last)
+	}
+}
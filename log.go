@@ -58,3 +58,30 @@ func ErrorLogWorker() {
 func init() {
 	go ErrorLogWorker() // Start the ErrorLogWorker as a goroutine
 }
+
+// onceLogger writes to a Logger like Printonce: a message equal to the previous one is skipped,
+// so a retry loop does not flood the log with the same error.
+type onceLogger struct {
+	// lock is a channel used to control access to previous (one at a time).
+	lock chan int
+	// previous is the last logged message.
+	previous string
+	logger   *log.Logger
+}
+
+// newOnceLogger creates a onceLogger writing to logger.
+func newOnceLogger(logger *log.Logger) *onceLogger {
+	return &onceLogger{lock: make(chan int, 1), logger: logger}
+}
+
+// printonce logs message unless it equals the previous one.
+func (l *onceLogger) printonce(message string) {
+	l.lock <- 1
+	defer func() { <-l.lock }()
+
+	if message == l.previous {
+		return
+	}
+	l.previous = message
+	l.logger.Println(message)
+}
@@ -0,0 +1,89 @@
+package netchan
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTimeout limits every wait for a message in the tests.
+const testTimeout = 10 * time.Second
+
+// testContext returns a context which is canceled when the test ends.
+func testContext(t *testing.T) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// freeAddr returns a local address nobody listens on, for tests which start a server late or twice.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+// startServer starts a server on a random local port.
+func startServer(t *testing.T, ctx context.Context, options Options) *Server {
+	t.Helper()
+	server, err := NewServerWithOptions(ctx, "127.0.0.1:0", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// startClient connects a client to addr.
+func startClient(t *testing.T, ctx context.Context, addr string, options Options) *Client {
+	t.Helper()
+	client, err := NewClientWithOptions(ctx, addr, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// receive returns the next message from ch, it fails the test when none arrives in time.
+func receive(t *testing.T, ch <-chan Message) Message {
+	t.Helper()
+	select {
+	case message, ok := <-ch:
+		if !ok {
+			t.Fatal("channel closed")
+		}
+		return message
+	case <-time.After(testTimeout):
+		t.Fatal("no message")
+	}
+	return Message{}
+}
+
+// receivePayload returns the int payload of the next message from ch.
+func receivePayload(t *testing.T, ch <-chan Message) int {
+	t.Helper()
+	message := receive(t, ch)
+	payload, ok := message.Payload.(int)
+	if !ok {
+		t.Fatalf("unexpected message %+v", message)
+	}
+	return payload
+}
+
+// receiveDeadLetter returns the next dead letter from ch.
+func receiveDeadLetter(t *testing.T, ch <-chan DeadLetter) DeadLetter {
+	t.Helper()
+	select {
+	case letter := <-ch:
+		return letter
+	case <-time.After(testTimeout):
+		t.Fatal("no dead letter")
+	}
+	return DeadLetter{}
+}
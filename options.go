@@ -0,0 +1,272 @@
+package netchan
+
+import (
+	"crypto/tls"
+	"log"
+	"time"
+)
+
+// Options holds tunable settings for servers and clients.
+// Zero values are replaced by the defaults returned from DefaultOptions,
+// so it is enough to set only the fields you want to change.
+type Options struct {
+	// SendBufferSize is the queue length of send channels (default 1).
+	SendBufferSize int
+	// ReceiveBufferSize is the queue length of receive channels (default 1000).
+	ReceiveBufferSize int
+	// ReadyQueueSize is the queue length of ready client addresses in the Listen dispatcher (default 10000000).
+	ReadyQueueSize int
+	// DisconnectQueueSize is the queue length of disconnect notifications on the server (default 100000).
+	DisconnectQueueSize int
+	// EventBufferSize is the queue length of the Events channel, events are dropped when it is full (default 1000).
+	EventBufferSize int
+	// DeadLetterBufferSize is the queue length of the DeadLetters channel, dead letters are dropped when it is full (default 1000).
+	DeadLetterBufferSize int
+
+	// DialTimeout limits a single TCP+TLS dial attempt (default 15s).
+	// A server waits as long for the peer ID of a new client.
+	DialTimeout time.Duration
+	// PeerID identifies a client to the server across reconnects, the server uses it as Message.From
+	// of the client messages and in Message.To of messages for it. Empty derives it from the public key
+	// of ClientCertificate, or generates a random one for every Client. The server rejects a client
+	// whose peer ID is in use by another connection, the client then retries after RespawnDelay.
+	PeerID string
+	// ClientCertificate is presented by a client to the server instead of the certificates in TLSConfig,
+	// which may be shared with a server. See NewClientCertificate. Nil keeps TLSConfig as it is.
+	ClientCertificate *tls.Certificate
+	// VerifyPeerID makes a server require a certificate from every client and accept only the peer ID
+	// derived from its public key, so a client cannot claim the ID of another one. Clients need
+	// ClientCertificate and no PeerID. Without TLSConfig.ClientCAs any certificate is accepted,
+	// with them it must be signed by one of these CAs. Used by servers only.
+	VerifyPeerID bool
+	// InitialConnectTimeout limits how long a client waits for its first connection.
+	// Zero means wait until the server becomes reachable.
+	InitialConnectTimeout time.Duration
+	// LazyConnect makes a client return immediately and connect in background.
+	LazyConnect bool
+	// CloseOnDisconnect makes a client stop instead of reconnecting when the server disconnects,
+	// so its receive channel is closed after draining.
+	CloseOnDisconnect bool
+	// RespawnDelay is the pause before every dial attempt of a client (default 1s).
+	RespawnDelay time.Duration
+	// ListenRetry makes a server retry binding a busy or invalid address instead of returning an error.
+	ListenRetry bool
+	// ListenRetryDelay is the first pause between attempts to bind the listening port (default 5s).
+	// It doubles after every failed attempt up to ListenRetryMaxDelay.
+	ListenRetryDelay time.Duration
+	// ListenRetryMaxDelay limits the pause between bind attempts (default 1m).
+	ListenRetryMaxDelay time.Duration
+	// ListenRetryAttempts limits the number of bind attempts, zero means no limit.
+	ListenRetryAttempts int
+
+	// SendRetryAttempts limits the attempts to write one message, a message whose write failed
+	// that often is handed to DeadLetters. Zero means no limit.
+	// A failed message is sent again on the next connection before newer messages.
+	SendRetryAttempts int
+	// SendRetryDelay is the pause before a client reconnects after a failed write (default 1s),
+	// it doubles after every further failed write up to SendRetryMaxDelay (default 1m).
+	SendRetryDelay    time.Duration
+	SendRetryMaxDelay time.Duration
+
+	// Reliable enables at-least-once delivery: every sent message gets an ID and is kept
+	// until the peer acknowledges it, unacknowledged messages are retransmitted after reconnect.
+	// Messages may be delivered more than once.
+	Reliable bool
+	// PeerRetention is how long a server keeps the unacknowledged messages of a disconnected client
+	// in Reliable mode, they are sent again when it reconnects with the same peer ID (default 1m).
+	// Afterwards they are handed to DeadLetters with ErrPeerDisconnected.
+	PeerRetention time.Duration
+	// Sync makes channels unbuffered and keeps at most one message in flight per connection:
+	// the next message is taken from the send channel only after the peer acknowledged the previous one.
+	// On the channels of Dial, Listen and the typed variants a value is acknowledged only after the peer
+	// application took it from its receive channel, and the next value is taken from the send channel
+	// only then. A send returns when netchan took the value, use Client.SendSync to wait for the
+	// acknowledgement of this very message. Enables Reliable, SendBufferSize and ReceiveBufferSize are ignored.
+	Sync bool
+	// ExactlyOnce enables Reliable and drops retransmitted messages which were already delivered.
+	// The receiver remembers the last DedupeWindow IDs of every sender.
+	ExactlyOnce bool
+	// DedupeWindow is the number of message IDs remembered per sender in ExactlyOnce mode (default 10000).
+	DedupeWindow int
+	// DedupeFile persists remembered IDs across restarts in ExactlyOnce mode, empty keeps them in memory only.
+	DedupeFile string
+	// DedupeRetention is how long a sender is remembered after its last message in ExactlyOnce mode (default 24h).
+	// Every restart of a client is a new sender, so idle ones are forgotten to bound memory and DedupeFile.
+	DedupeRetention time.Duration
+	// DedupeMaxSenders is the number of senders remembered in ExactlyOnce mode, the least recently seen
+	// are forgotten first (default 10000).
+	DedupeMaxSenders int
+	// Ordered numbers sent messages per stream and delivers received messages of every sender
+	// in that order, also across reconnects: messages which arrive early are held back
+	// until the missing ones arrive. Enables Reliable, so a missing message is retransmitted
+	// instead of stalling the stream. Set it on both sides.
+	Ordered bool
+	// ReorderBufferSize is the number of messages held back per sender in Ordered mode (default 1000).
+	// When it is exceeded the missing messages are treated as lost and skipped, which only happens
+	// when the sender gave them up, for example because they expired.
+	ReorderBufferSize int
+	// FlowControl limits the messages in flight per connection: the receiver grants credits
+	// for CreditWindow messages and more as they are handed to its receive channel, the sender waits
+	// when it runs out of credits. A slow receiver then blocks its own senders instead of the
+	// connection reading its acknowledgements. Set it on both sides.
+	FlowControl bool
+	// CreditWindow is the number of messages a peer may send ahead in FlowControl mode (default 100).
+	CreditWindow int
+	// QueueDir keeps outgoing messages of a client in a write-ahead log in this directory
+	// until the server acknowledges them, also while disconnected, and queued messages survive
+	// a restart of the process. The send channel is unbuffered then, but a send returns when the value
+	// was taken from it, before it is on disk: use Client.Enqueue to return after the write was synced.
+	// Enables Reliable, empty keeps outgoing messages in memory only. Used by clients only.
+	QueueDir string
+
+	// TTL sets Message.Expires to the time a message was taken from the send channel plus TTL,
+	// unless the message has its own Expires. Expired messages are dropped by the sender,
+	// the server router and the receiver. Zero keeps messages forever.
+	TTL time.Duration
+
+	// Relay lets a server forward messages from a client whose To is the peer ID of another
+	// connected client, if the policy allows it. Nil delivers them to the server like any other message.
+	// Without VerifyPeerID clients choose their peer IDs freely, so a policy cannot tell them apart.
+	Relay RelayPolicy
+	// Balancer picks the client for every payload of the Listen dispatcher. Nil hands every payload
+	// to a client which sent a message before, as a sign that it is ready for more.
+	// A Balancer keeps state, so use a new one for every Listen.
+	Balancer Balancer
+	// TLSConfig is used for listening and dialing. A self-signed certificate is generated when nil.
+	TLSConfig *tls.Config
+	// Logger receives netchan log output (default is the standard logger).
+	Logger *log.Logger
+	// Codec encodes messages on the wire (default GobCodec).
+	Codec Codec
+
+	// dispatched is set by the Dial and Listen dispatchers in Sync mode: a message of the main receive channel
+	// is acknowledged only after the dispatcher handed its payload to the application.
+	dispatched bool
+}
+
+// DefaultOptions returns the settings used by Listen, Dial, AdvancedListen and AdvancedDial.
+func DefaultOptions() Options {
+	return Options{
+		SendBufferSize:       1,
+		ReceiveBufferSize:    1000,
+		ReadyQueueSize:       10000000,
+		DisconnectQueueSize:  100000,
+		EventBufferSize:      1000,
+		DeadLetterBufferSize: 1000,
+		DedupeWindow:         10000,
+		PeerRetention:        time.Minute,
+		DedupeRetention:      24 * time.Hour,
+		DedupeMaxSenders:     10000,
+		ReorderBufferSize:    1000,
+		CreditWindow:         100,
+		DialTimeout:          time.Second * 15,
+		RespawnDelay:         time.Second * 1,
+		ListenRetryDelay:     time.Second * 5,
+		ListenRetryMaxDelay:  time.Minute,
+		SendRetryDelay:       time.Second,
+		SendRetryMaxDelay:    time.Minute,
+		Logger:               log.Default(),
+		Codec:                GobCodec{},
+	}
+}
+
+// withDefaults returns a copy of options with all zero fields set to their defaults.
+func (options Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if options.SendBufferSize <= 0 {
+		options.SendBufferSize = defaults.SendBufferSize
+	}
+	if options.ReceiveBufferSize <= 0 {
+		options.ReceiveBufferSize = defaults.ReceiveBufferSize
+	}
+	if options.ReadyQueueSize <= 0 {
+		options.ReadyQueueSize = defaults.ReadyQueueSize
+	}
+	if options.DisconnectQueueSize <= 0 {
+		options.DisconnectQueueSize = defaults.DisconnectQueueSize
+	}
+	if options.EventBufferSize <= 0 {
+		options.EventBufferSize = defaults.EventBufferSize
+	}
+	if options.DeadLetterBufferSize <= 0 {
+		options.DeadLetterBufferSize = defaults.DeadLetterBufferSize
+	}
+	if options.ExactlyOnce || options.Sync || options.Ordered || options.QueueDir != "" {
+		options.Reliable = true
+	}
+	if options.PeerRetention <= 0 {
+		options.PeerRetention = defaults.PeerRetention
+	}
+	if options.DedupeWindow <= 0 {
+		options.DedupeWindow = defaults.DedupeWindow
+	}
+	if options.DedupeRetention <= 0 {
+		options.DedupeRetention = defaults.DedupeRetention
+	}
+	if options.DedupeMaxSenders <= 0 {
+		options.DedupeMaxSenders = defaults.DedupeMaxSenders
+	}
+	if options.CreditWindow <= 0 {
+		options.CreditWindow = defaults.CreditWindow
+	}
+	if options.ReorderBufferSize <= 0 {
+		options.ReorderBufferSize = defaults.ReorderBufferSize
+	}
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = defaults.DialTimeout
+	}
+	if options.RespawnDelay <= 0 {
+		options.RespawnDelay = defaults.RespawnDelay
+	}
+	if options.ListenRetryDelay <= 0 {
+		options.ListenRetryDelay = defaults.ListenRetryDelay
+	}
+	if options.ListenRetryMaxDelay <= 0 {
+		options.ListenRetryMaxDelay = defaults.ListenRetryMaxDelay
+	}
+	if options.SendRetryDelay <= 0 {
+		options.SendRetryDelay = defaults.SendRetryDelay
+	}
+	if options.SendRetryMaxDelay <= 0 {
+		options.SendRetryMaxDelay = defaults.SendRetryMaxDelay
+	}
+	if options.Logger == nil {
+		options.Logger = defaults.Logger
+	}
+	if options.Codec == nil {
+		options.Codec = defaults.Codec
+	}
+	return options
+}
+
+// stamp sets the Expires deadline of message from TTL if it has none.
+func (options Options) stamp(message Message) Message {
+	if options.TTL > 0 && message.Expires.IsZero() {
+		message.Expires = time.Now().Add(options.TTL)
+	}
+	return message
+}
+
+// sendBufferSize returns the queue length for send channels, zero in Sync mode and with QueueDir.
+func (options Options) sendBufferSize() int {
+	if options.Sync || options.QueueDir != "" {
+		return 0
+	}
+	return options.SendBufferSize
+}
+
+// receiveBufferSize returns the queue length for receive channels, zero in Sync mode.
+func (options Options) receiveBufferSize() int {
+	if options.Sync {
+		return 0
+	}
+	return options.ReceiveBufferSize
+}
+
+// tlsConfig returns the configured TLS settings or generates a self-signed configuration.
+func (options Options) tlsConfig() (*tls.Config, error) {
+	if options.TLSConfig != nil {
+		return options.TLSConfig, nil
+	}
+	return generateTLSConfig()
+}
@@ -0,0 +1,23 @@
+package netchan
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithDefaults(t *testing.T) {
+	options := Options{ReceiveBufferSize: 5, RespawnDelay: time.Millisecond}.withDefaults()
+	defaults := DefaultOptions()
+	if options.ReceiveBufferSize != 5 || options.RespawnDelay != time.Millisecond {
+		t.Fatal("set fields were replaced", options)
+	}
+	if options.SendBufferSize != defaults.SendBufferSize || options.DialTimeout != defaults.DialTimeout {
+		t.Fatal("zero fields were not replaced", options)
+	}
+	if options.Logger == nil || options.Codec == nil {
+		t.Fatal("no logger or codec", options)
+	}
+	if n := (Options{SendBufferSize: -1}).withDefaults().SendBufferSize; n != defaults.SendBufferSize {
+		t.Fatal(n)
+	}
+}
@@ -0,0 +1,250 @@
+package netchan
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// outbox keeps sent messages until the peer acknowledges them.
+// It outlives a single connection, so unacknowledged messages can be retransmitted after reconnect.
+// An outbox opened with openOutbox also writes every message to a directory (write-ahead log),
+// so messages survive a restart of the process.
+type outbox struct {
+	// origin identifies the sender in Message.Origin.
+	origin string
+	// lock is a channel used to control access to pending (one at a time).
+	lock chan int
+	// orderLock is a channel used to make numbering, writing and storing a new message one step,
+	// so messages become pending in the order of their IDs and sequence numbers (one at a time).
+	orderLock chan int
+	// lastID is the ID given to the latest message.
+	lastID uint64
+	// pending holds messages waiting for acknowledgement by ID.
+	pending map[uint64]Message
+	// added gets a signal every time a message is added.
+	added chan struct{}
+	// dir holds one file per pending message, empty keeps messages in memory only.
+	dir string
+	// codec writes and reads the files in dir.
+	codec Codec
+}
+
+// queueFileSuffix is the file name suffix of a message in the write-ahead log, the name itself is the message ID.
+const queueFileSuffix = ".msg"
+
+// newOutbox creates an empty outbox for messages of origin.
+func newOutbox(origin string) *outbox {
+	return &outbox{
+		origin:    origin,
+		lock:      make(chan int, 1),
+		orderLock: make(chan int, 1),
+		pending:   make(map[uint64]Message),
+		added:     make(chan struct{}, 1),
+	}
+}
+
+// openOutbox creates an outbox backed by dir and loads the messages left there by a previous process.
+// Loaded messages keep their origin and ID, new messages get origin and IDs above the loaded ones.
+func openOutbox(origin string, dir string, codec Codec) (*outbox, error) {
+	o := newOutbox(origin)
+	o.dir = dir
+	o.codec = codec
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// Leftover of a write interrupted by a crash, the send never returned.
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, queueFileSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, queueFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		message, err := o.read(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("netchan: cannot read queued message %s: %w", name, err)
+		}
+		message.ID = id
+		o.pending[id] = message
+		if id > o.lastID {
+			o.lastID = id
+		}
+	}
+	return o, nil
+}
+
+// add numbers the message with sequence, which may be nil, gives it a new ID and the outbox origin,
+// stores it in memory until it is acknowledged and returns it. It is never written to dir.
+func (o *outbox) add(message Message, sequence *sequencer) Message {
+	o.orderLock <- 1
+	defer func() { <-o.orderLock }()
+
+	message = o.number(message, sequence)
+	o.store(message)
+	return message
+}
+
+// push works like add, but first writes the message to dir.
+// If writing fails the message is kept in memory only and the error is returned.
+func (o *outbox) push(message Message, sequence *sequencer) (Message, error) {
+	o.orderLock <- 1
+	defer func() { <-o.orderLock }()
+
+	message = o.number(message, sequence)
+	// The file is written before the message becomes pending, so an ack can never come before it exists.
+	err := o.write(message)
+	o.store(message)
+	return message, err
+}
+
+// number gives message its sequence number and a new ID. Caller must hold orderLock.
+func (o *outbox) number(message Message, sequence *sequencer) Message {
+	message = sequence.next(message)
+
+	o.lock <- 1
+	defer func() { <-o.lock }()
+	o.lastID++
+	message.ID = o.lastID
+	message.Origin = o.origin
+	return message
+}
+
+// store keeps message as pending and signals added. Caller must hold orderLock.
+func (o *outbox) store(message Message) {
+	o.lock <- 1
+	defer func() { <-o.lock }()
+
+	o.pending[message.ID] = message
+	select {
+	case o.added <- struct{}{}:
+	default:
+	}
+}
+
+// update replaces a pending message with the same ID, for example to count its send attempts.
+func (o *outbox) update(message Message) {
+	o.lock <- 1
+	defer func() { <-o.lock }()
+
+	if _, ok := o.pending[message.ID]; ok {
+		o.pending[message.ID] = message
+	}
+}
+
+// ack removes an acknowledged message.
+func (o *outbox) ack(id uint64) {
+	o.drop(id, nil)
+}
+
+// drop removes a message, reason tells a waiting SendSync why: nil when it was acknowledged,
+// otherwise why it was given up.
+func (o *outbox) drop(id uint64, reason error) {
+	o.lock <- 1
+	defer func() { <-o.lock }()
+
+	message, ok := o.pending[id]
+	if !ok {
+		return
+	}
+	if o.dir != "" {
+		// A file which cannot be removed is only retransmitted once more after restart.
+		os.Remove(o.path(id))
+	}
+	delete(o.pending, id)
+	message.finish(reason)
+}
+
+// unacked returns all messages waiting for acknowledgement in the order they were sent.
+func (o *outbox) unacked() []Message {
+	return o.after(0)
+}
+
+// after returns the messages waiting for acknowledgement with an ID above id, ordered by ID.
+func (o *outbox) after(id uint64) []Message {
+	o.lock <- 1
+	defer func() { <-o.lock }()
+
+	messages := make([]Message, 0, len(o.pending))
+	for _, message := range o.pending {
+		if message.ID > id {
+			messages = append(messages, message)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages
+}
+
+// oldest returns the lowest ID waiting for acknowledgement, zero if nothing is pending.
+func (o *outbox) oldest() uint64 {
+	o.lock <- 1
+	defer func() { <-o.lock }()
+
+	var oldest uint64
+	for id := range o.pending {
+		if oldest == 0 || id < oldest {
+			oldest = id
+		}
+	}
+	return oldest
+}
+
+// size returns the number of messages waiting for acknowledgement.
+func (o *outbox) size() int {
+	o.lock <- 1
+	defer func() { <-o.lock }()
+
+	return len(o.pending)
+}
+
+// path returns the file name of message id in dir.
+func (o *outbox) path(id uint64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%020d%s", id, queueFileSuffix))
+}
+
+// write stores message in dir. The file is replaced atomically, so a crash never leaves half a message.
+func (o *outbox) write(message Message) error {
+	tmp, err := os.CreateTemp(o.dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := o.codec.NewEncoder(tmp).Encode(message); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), o.path(message.ID))
+}
+
+// read loads one message written by write.
+func (o *outbox) read(name string) (Message, error) {
+	var message Message
+	file, err := os.Open(name)
+	if err != nil {
+		return message, err
+	}
+	defer file.Close()
+	err = o.codec.NewDecoder(file).Decode(&message)
+	return message, err
+}
@@ -0,0 +1,42 @@
+package netchan
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReliableRetransmitsAfterServerRestart(t *testing.T) {
+	ctx := testContext(t)
+	addr := freeAddr(t)
+	server, err := NewServer(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := startClient(t, ctx, addr, Options{Reliable: true, RespawnDelay: 100 * time.Millisecond})
+	for i := 1; i <= 50; i++ {
+		client.Send() <- Message{Payload: i}
+	}
+	got := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		got[receivePayload(t, server.Receive())] = true
+	}
+	server.Close()
+	// Messages the stopped server handed to its receive channel were delivered.
+	for m := range server.Receive() {
+		got[m.Payload.(int)] = true
+	}
+	go func() {
+		for i := 51; i <= 100; i++ {
+			client.Send() <- Message{Payload: i}
+		}
+	}()
+	// The rest is sent again to the new server.
+	time.Sleep(300 * time.Millisecond)
+	server, err = NewServer(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(got) < 100 {
+		got[receivePayload(t, server.Receive())] = true
+	}
+}
@@ -0,0 +1,87 @@
+package netchan
+
+import (
+	"strconv"
+	"time"
+)
+
+// peerState holds what a server keeps for a client across its reconnects, so messages
+// which were not acknowledged on one connection are sent again on the next one.
+type peerState struct {
+	outbox   *outbox     // unacknowledged messages in reliable mode, nil otherwise
+	sequence *sequencer  // numbers messages to the client in ordered mode, nil otherwise
+	retry    *retryQueue // messages whose write failed, sent first on the next connection
+	// connections counts the connections of the client using this state, a rejected duplicate never gets it.
+	connections int
+	// disconnected is when the last connection of the client ended.
+	disconnected time.Time
+}
+
+// acquirePeer returns the state of client peer for a new connection, it is created on first use.
+func (s *Server) acquirePeer(peer string) *peerState {
+	s.peersLock <- 1
+	defer func() { <-s.peersLock }()
+
+	state, ok := s.peers[peer]
+	if !ok {
+		// A forgotten client starts a new stream, so it does not take the new IDs for ones it has seen.
+		s.streams++
+		origin := s.origin + "/" + peer + "/" + strconv.FormatUint(s.streams, 10)
+		state = &peerState{retry: newRetryQueue(s.options)}
+		if s.options.Reliable {
+			state.outbox = newOutbox(origin)
+		}
+		if s.options.Ordered {
+			state.sequence = newSequencer(origin)
+		}
+		s.peers[peer] = state
+	}
+	state.connections++
+	return state
+}
+
+// releasePeer ends a connection of client peer. The state is kept for its reconnect,
+// unless the server stops: then the state is forgotten and returned, nil otherwise.
+func (s *Server) releasePeer(peer string) *peerState {
+	s.peersLock <- 1
+	defer func() { <-s.peersLock }()
+
+	state := s.peers[peer]
+	state.connections--
+	state.disconnected = time.Now()
+	if state.connections > 0 || s.ctx.Err() == nil {
+		return nil
+	}
+	delete(s.peers, peer)
+	return state
+}
+
+// expirePeers forgets and returns the states of clients which were disconnected
+// for longer than Options.PeerRetention before now, or of all disconnected clients if all is set.
+func (s *Server) expirePeers(now time.Time, all bool) map[string]*peerState {
+	s.peersLock <- 1
+	defer func() { <-s.peersLock }()
+
+	expired := make(map[string]*peerState)
+	for peer, state := range s.peers {
+		if state.connections > 0 || (!all && now.Sub(state.disconnected) < s.options.PeerRetention) {
+			continue
+		}
+		delete(s.peers, peer)
+		expired[peer] = state
+	}
+	return expired
+}
+
+// forgetPeer hands the messages kept for a client which did not come back to DeadLetters.
+func (s *Server) forgetPeer(peer string, state *peerState) {
+	messages := state.retry.drain()
+	if state.outbox != nil {
+		messages = append(messages, state.outbox.unacked()...)
+	}
+	for _, message := range messages {
+		if !s.expiry.check(message, peer) {
+			s.deadLetters.put(message, ErrPeerDisconnected)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package netchan
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestServerReplaysToReconnectedPeer(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{Reliable: true, PeerRetention: 500 * time.Millisecond})
+	options := Options{PeerID: "w", ReceiveBufferSize: 1, RespawnDelay: 50 * time.Millisecond}
+	first := startClient(t, ctx, server.Addr().String(), options)
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		server.Send() <- Message{To: "w", Payload: i}
+	}
+	time.Sleep(200 * time.Millisecond)
+	first.Close()
+	got := make(map[int]bool)
+	for m := range first.Receive() {
+		got[m.Payload.(int)] = true
+	}
+
+	// The same peer ID gets what the first connection did not acknowledge.
+	time.Sleep(100 * time.Millisecond)
+	second := startClient(t, ctx, server.Addr().String(), options)
+	for len(got) < 10 {
+		got[receivePayload(t, second.Receive())] = true
+	}
+	second.Close()
+	for range second.Receive() {
+	}
+}
+
+func TestServerForgetsPeerAfterRetention(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{Reliable: true, PeerRetention: 500 * time.Millisecond})
+	client := startClient(t, ctx, server.Addr().String(), Options{PeerID: "x", ReceiveBufferSize: 1})
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		server.Send() <- Message{To: "x", Payload: i}
+	}
+	time.Sleep(200 * time.Millisecond)
+	client.Close()
+	if d := receiveDeadLetter(t, server.DeadLetters()); !errors.Is(d.Reason, ErrPeerDisconnected) {
+		t.Fatal(d)
+	}
+}
+
+func TestTinyPeerRetention(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{Reliable: true, PeerRetention: 1})
+	client := startClient(t, ctx, server.Addr().String(), Options{PeerID: "x"})
+	time.Sleep(100 * time.Millisecond)
+	server.Send() <- Message{To: "x", Payload: 1}
+	if v := receivePayload(t, client.Receive()); v != 1 {
+		t.Fatal(v)
+	}
+	client.Close()
+	server.Close()
+	for range server.Receive() {
+	}
+}
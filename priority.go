@@ -0,0 +1,96 @@
+package netchan
+
+// Priority orders messages waiting to be sent on one connection, higher priorities are sent first.
+type Priority uint8
+
+const (
+	// PriorityNormal is the priority of regular data (zero value).
+	PriorityNormal Priority = iota
+	// PriorityHigh overtakes messages with PriorityNormal.
+	PriorityHigh
+	// PriorityCritical overtakes all other messages, meant for control messages like cancel or shutdown.
+	PriorityCritical
+)
+
+// priorityLevels is the number of priorities, higher values are treated as PriorityCritical.
+const priorityLevels = int(PriorityCritical) + 1
+
+// lanes holds one send channel per priority of a connection, the index is the Priority.
+type lanes []chan Message
+
+// newLanes creates a lane for every priority, each buffering size messages.
+func newLanes(size int) lanes {
+	l := make(lanes, priorityLevels)
+	for i := range l {
+		l[i] = make(chan Message, size)
+	}
+	return l
+}
+
+// lane returns the channel for messages with priority p.
+// Priorities above the highest lane use the highest lane.
+func (l lanes) lane(p Priority) chan Message {
+	if int(p) >= len(l) {
+		return l[len(l)-1]
+	}
+	return l[p]
+}
+
+// above returns a copy of l holding only the lanes of priorities above p, the others are nil.
+func (l lanes) above(p Priority) lanes {
+	above := make(lanes, priorityLevels)
+	for i := int(p) + 1; i < len(l); i++ {
+		above[i] = l[i]
+	}
+	return above
+}
+
+// close closes every lane.
+func (l lanes) close() {
+	for _, lane := range l {
+		close(lane)
+	}
+}
+
+// drain takes every message waiting in the lanes without blocking.
+func (l lanes) drain() []Message {
+	var messages []Message
+	for _, lane := range l {
+		for waiting := true; waiting; {
+			select {
+			case message, ok := <-lane:
+				if ok {
+					messages = append(messages, message)
+				}
+				waiting = ok
+			default:
+				waiting = false
+			}
+		}
+	}
+	return messages
+}
+
+// next returns the lanes to wait on: only the highest priority lane holding messages,
+// or every lane when none of them holds any. The result has priorityLevels entries, nil entries block forever.
+func (l lanes) next() lanes {
+	next := make(lanes, priorityLevels)
+	for p := len(l) - 1; p >= 0; p-- {
+		if l[p] != nil && len(l[p]) > 0 {
+			next[p] = l[p]
+			return next
+		}
+	}
+	copy(next, l)
+	return next
+}
+
+// open reports whether any lane is left, the writer sets lanes to nil after they were closed.
+func (l lanes) open() bool {
+	for _, lane := range l {
+		if lane != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package netchan
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPriority(t *testing.T) {
+	ctx := testContext(t)
+	addr := freeAddr(t)
+	client := startClient(t, ctx, addr, Options{SendBufferSize: 1000, LazyConnect: true, RespawnDelay: 100 * time.Millisecond})
+	for i := 1; i <= 500; i++ {
+		client.Send() <- Message{Payload: i}
+	}
+	client.Send() <- Message{Payload: -1, Priority: PriorityCritical}
+	client.Send() <- Message{Payload: -2, Priority: PriorityHigh}
+	time.Sleep(50 * time.Millisecond)
+
+	server, err := NewServer(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := receivePayload(t, server.Receive()); v != -1 {
+		t.Fatal(v)
+	}
+	if v := receivePayload(t, server.Receive()); v != -2 {
+		t.Fatal(v)
+	}
+	for want := 1; want <= 500; want++ {
+		if v := receivePayload(t, server.Receive()); v != want {
+			t.Fatal(want, v)
+		}
+	}
+	// The close frame comes after all data.
+	close(client.Send())
+	if m := receive(t, server.Receive()); m.Kind != KindClose {
+		t.Fatal(m)
+	}
+}
+
+func TestSendPriorityOvertakesFullLane(t *testing.T) {
+	ctx := testContext(t)
+	addr := freeAddr(t)
+	// Default buffers: the normal lane is full after the first message.
+	client := startClient(t, ctx, addr, Options{LazyConnect: true, RespawnDelay: 100 * time.Millisecond})
+	go func() {
+		for i := 1; i <= 100; i++ {
+			client.Send() <- Message{Payload: i}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	client.SendPriority(PriorityCritical) <- Message{Payload: -1}
+	time.Sleep(100 * time.Millisecond)
+
+	server, err := NewServer(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := receivePayload(t, server.Receive()); v != -1 {
+		t.Fatal(v)
+	}
+	for want := 1; want <= 100; want++ {
+		if v := receivePayload(t, server.Receive()); v != want {
+			t.Fatal(want, v)
+		}
+	}
+}
+
+func TestServerSendPriorityOvertakesSlowClient(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{FlowControl: true, CreditWindow: 5})
+	// The client reads nothing for now, so the server runs out of credits and its lanes fill up.
+	client := startClient(t, ctx, server.Addr().String(), Options{PeerID: "slow", FlowControl: true, CreditWindow: 5, ReceiveBufferSize: 1})
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		for i := 1; i <= 100; i++ {
+			server.Send() <- Message{To: "slow", Payload: i}
+		}
+	}()
+	time.Sleep(300 * time.Millisecond)
+	server.SendPriority(PriorityCritical) <- Message{To: "slow", Payload: -1}
+	time.Sleep(300 * time.Millisecond)
+
+	position := 0
+	for i := 0; i <= 100; i++ {
+		if receivePayload(t, client.Receive()) == -1 {
+			position = i
+		}
+	}
+	// Only the messages sent with the first credits arrive before it, not those waiting in the lane.
+	if position > 5 {
+		t.Fatal("critical message arrived at position", position)
+	}
+}
+
+func TestSendPriorityAfterClose(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{})
+	client := startClient(t, ctx, server.Addr().String(), Options{})
+	if client.SendPriority(PriorityNormal) != client.Send() || server.SendPriority(PriorityNormal) != server.Send() {
+		t.Fatal("PriorityNormal is not Send")
+	}
+	close(client.Send())
+	client.SendPriority(PriorityHigh) <- Message{Payload: 1}
+	if d := receiveDeadLetter(t, client.DeadLetters()); d.Reason != ErrClosed {
+		t.Fatal(d)
+	}
+	close(server.Send())
+	server.SendPriority(PriorityHigh) <- Message{To: client.ID(), Payload: 2}
+	if d := receiveDeadLetter(t, server.DeadLetters()); d.Reason != ErrClosed {
+		t.Fatal(d)
+	}
+}
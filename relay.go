@@ -0,0 +1,53 @@
+package netchan
+
+// RelayPolicy decides whether the server relays a message from client from to client to,
+// both given by peer ID. It is called from connection goroutines concurrently.
+type RelayPolicy func(from string, to string) bool
+
+// AllowAllRelays is a RelayPolicy which lets every client send to every other client.
+func AllowAllRelays(from string, to string) bool {
+	return true
+}
+
+// RelayACL returns a RelayPolicy which allows relays listed in acl: it maps the peer ID of a sender
+// to the peer IDs it may send to. "*" as sender or recipient matches any client.
+// The map is read on every relay, do not change it afterwards.
+// The ACL gives no security unless the server sets Options.VerifyPeerID: otherwise the peer ID
+// is whatever the client claims, and any client can send as a sender listed in acl.
+func RelayACL(acl map[string][]string) RelayPolicy {
+	return func(from string, to string) bool {
+		for _, sender := range []string{from, "*"} {
+			for _, recipient := range acl[sender] {
+				if recipient == to || recipient == "*" {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// serveRelay forwards a data message from a client whose To is another connected client,
+// if Options.Relay allows it. Denied messages end up in DeadLetters with ErrRelayDenied,
+// messages whose recipient disconnected before they were routed with ErrPeerDisconnected.
+// It reports whether the message was relayed or denied.
+func (s *Server) serveRelay(message Message) bool {
+	if s.options.Relay == nil || message.Kind != KindData || message.To == "" || message.To == message.From {
+		return false
+	}
+	if s.addressBookManager("get", message.To, addressBook{}) == nil {
+		// Not a connected client, the message is for the server itself.
+		return false
+	}
+	if !s.options.Relay(message.From, message.To) {
+		s.deadLetters.put(message, ErrRelayDenied)
+		return true
+	}
+	// Numbers of the sender stream mean nothing in the stream to the recipient.
+	message.ID, message.Origin, message.Seq = 0, "", 0
+	select {
+	case s.relays <- message:
+	case <-s.ctx.Done():
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package netchan
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRelayACL(t *testing.T) {
+	acl := RelayACL(map[string][]string{"a": {"b"}, "*": {"hub"}})
+	if !acl("a", "b") || acl("b", "a") || !acl("x", "hub") {
+		t.Fatal("unexpected decision")
+	}
+}
+
+func TestRelay(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{Relay: RelayACL(map[string][]string{"a": {"b"}}), Ordered: true})
+	a := startClient(t, ctx, server.Addr().String(), Options{PeerID: "a", Ordered: true})
+	b := startClient(t, ctx, server.Addr().String(), Options{PeerID: "b", Ordered: true})
+	time.Sleep(200 * time.Millisecond)
+
+	for i := 1; i <= 3; i++ {
+		a.Send() <- Message{To: "b", Payload: i}
+	}
+	for want := 1; want <= 3; want++ {
+		if m := receive(t, b.Receive()); m.Payload.(int) != want || m.From != "a" {
+			t.Fatal(want, m)
+		}
+	}
+	b.Send() <- Message{To: "a", Payload: 9}
+	if d := receiveDeadLetter(t, server.DeadLetters()); !errors.Is(d.Reason, ErrRelayDenied) {
+		t.Fatal(d)
+	}
+
+	// Messages without a client recipient still go to the server, and the server still reaches b.
+	a.Send() <- Message{Payload: 5}
+	if v := receivePayload(t, server.Receive()); v != 5 {
+		t.Fatal(v)
+	}
+	server.Send() <- Message{To: "b", Payload: 6}
+	if v := receivePayload(t, b.Receive()); v != 6 {
+		t.Fatal(v)
+	}
+}
+
+func TestRelayToDisconnectedPeer(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{Relay: AllowAllRelays})
+	// The recipient is gone by the time the router takes the relayed message.
+	server.relays <- Message{From: "a", To: "b", Payload: 1}
+	d := receiveDeadLetter(t, server.DeadLetters())
+	if !errors.Is(d.Reason, ErrPeerDisconnected) || d.Message.From != "a" {
+		t.Fatal(d)
+	}
+}
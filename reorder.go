@@ -0,0 +1,124 @@
+package netchan
+
+import (
+	"sort"
+)
+
+// sequencer numbers the messages of one stream in the order they are sent (ordered mode).
+type sequencer struct {
+	// origin identifies the stream in Message.Origin.
+	origin string
+	// lock is a channel used to control access to last (one at a time).
+	lock chan int
+	// last is the sequence number given to the latest message.
+	last uint64
+}
+
+// newSequencer creates a sequencer for the stream origin, the first message gets Seq 1.
+func newSequencer(origin string) *sequencer {
+	return &sequencer{origin: origin, lock: make(chan int, 1)}
+}
+
+// next gives message the next sequence number and the stream origin.
+// Messages which already have a sequence number (for example re-queued ones) keep it.
+func (s *sequencer) next(message Message) Message {
+	if s == nil || message.Seq != 0 {
+		return message
+	}
+	s.lock <- 1
+	defer func() { <-s.lock }()
+
+	s.last++
+	message.Seq = s.last
+	message.Origin = s.origin
+	return message
+}
+
+// reorder holds back received messages until all messages before them in their stream were delivered.
+// It outlives a single connection, so order is kept across reconnects.
+type reorder struct {
+	// lock is a channel used to control access to streams (one at a time).
+	lock chan int
+	// size is the number of messages held per stream before a gap is skipped.
+	size int
+	// streams maps Message.Origin to its state.
+	streams map[string]*reorderStream
+}
+
+// reorderStream holds the messages of one sender.
+type reorderStream struct {
+	expected uint64             // sequence number of the next message to deliver
+	held     map[uint64]Message // messages which arrived before expected, by sequence number
+}
+
+// newReorder creates a reorder which holds up to size messages per stream.
+func newReorder(size int) *reorder {
+	return &reorder{
+		lock:    make(chan int, 1),
+		size:    size,
+		streams: make(map[string]*reorderStream),
+	}
+}
+
+// add holds message until it is its turn. It returns false if a message with this
+// sequence number was delivered before, it must not be delivered again.
+// The first message seen from a stream starts it.
+func (r *reorder) add(message Message) bool {
+	r.lock <- 1
+	defer func() { <-r.lock }()
+
+	stream, ok := r.streams[message.Origin]
+	if !ok {
+		stream = &reorderStream{expected: message.Seq, held: make(map[uint64]Message)}
+		r.streams[message.Origin] = stream
+	}
+	if message.Seq < stream.expected {
+		return false
+	}
+	stream.held[message.Seq] = message
+	return true
+}
+
+// next removes and returns the next message of stream origin which may be delivered.
+// When more than size messages are held and the expected one is still missing,
+// the gap is skipped and the oldest held message is returned.
+func (r *reorder) next(origin string) (Message, bool) {
+	r.lock <- 1
+	defer func() { <-r.lock }()
+
+	stream, ok := r.streams[origin]
+	if !ok {
+		return Message{}, false
+	}
+	message, ok := stream.held[stream.expected]
+	if !ok && len(stream.held) > r.size {
+		// The missing messages are lost, do not wait for them any longer.
+		seqs := make([]uint64, 0, len(stream.held))
+		for seq := range stream.held {
+			seqs = append(seqs, seq)
+		}
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+		message, ok = stream.held[seqs[0]], true
+	}
+	if !ok {
+		return Message{}, false
+	}
+	delete(stream.held, message.Seq)
+	stream.expected = message.Seq + 1
+	return message, true
+}
+
+// undo puts back a message returned by next which could not be delivered.
+func (r *reorder) undo(message Message) {
+	r.lock <- 1
+	defer func() { <-r.lock }()
+
+	stream, ok := r.streams[message.Origin]
+	if !ok {
+		return
+	}
+	stream.held[message.Seq] = message
+	if message.Seq < stream.expected {
+		stream.expected = message.Seq
+	}
+}
@@ -0,0 +1,124 @@
+package netchan
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReorder(t *testing.T) {
+	r := newReorder(2)
+	message := func(seq uint64) Message { return Message{Origin: "a", Seq: seq} }
+	next := func() uint64 {
+		t.Helper()
+		m, ok := r.next("a")
+		if !ok {
+			t.Fatal("no message ready")
+		}
+		return m.Seq
+	}
+
+	r.add(message(1))
+	r.add(message(3))
+	if seq := next(); seq != 1 {
+		t.Fatal(seq)
+	}
+	// 3 waits for 2.
+	if _, ok := r.next("a"); ok {
+		t.Fatal("3 released before 2")
+	}
+	r.add(message(2))
+	if seq := next(); seq != 2 {
+		t.Fatal(seq)
+	}
+	if seq := next(); seq != 3 {
+		t.Fatal(seq)
+	}
+	if r.add(message(2)) {
+		t.Fatal("stale message accepted")
+	}
+
+	// More than the buffer size held back skips the gap.
+	r.add(message(5))
+	r.add(message(6))
+	if _, ok := r.next("a"); ok {
+		t.Fatal("gap skipped early")
+	}
+	r.add(message(7))
+	if seq := next(); seq != 5 {
+		t.Fatal(seq)
+	}
+	// An undelivered message is released again.
+	r.undo(message(5))
+	if seq := next(); seq != 5 {
+		t.Fatal(seq)
+	}
+	if seq := next(); seq != 6 {
+		t.Fatal(seq)
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{Ordered: true})
+	client := startClient(t, ctx, server.Addr().String(), Options{Ordered: true})
+	go func() {
+		for i := 1; i <= 200; i++ {
+			client.Send() <- Message{Payload: i}
+		}
+	}()
+	var from string
+	for i := 1; i <= 200; i++ {
+		m := receive(t, server.Receive())
+		if m.Payload.(int) != i || m.Seq != uint64(i) {
+			t.Fatal(i, m)
+		}
+		from = m.From
+	}
+	server.Send() <- Message{To: from, Payload: 9}
+	if m := receive(t, client.Receive()); m.Payload.(int) != 9 || m.Seq != 1 {
+		t.Fatal(m)
+	}
+}
+
+func TestOrderedAcrossServerRestart(t *testing.T) {
+	ctx := testContext(t)
+	addr := freeAddr(t)
+	server, err := NewServerWithOptions(ctx, addr, Options{Ordered: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := startClient(t, ctx, addr, Options{Ordered: true, RespawnDelay: 100 * time.Millisecond})
+	go func() {
+		for i := 1; i <= 100; i++ {
+			client.Send() <- Message{Payload: i}
+		}
+	}()
+	want := 1
+	for ; want <= 30; want++ {
+		if v := receivePayload(t, server.Receive()); v != want {
+			t.Fatal(want, v)
+		}
+	}
+	server.Close()
+	for m := range server.Receive() {
+		if m.Payload.(int) != want {
+			t.Fatal(want, m)
+		}
+		want++
+	}
+	time.Sleep(300 * time.Millisecond)
+	server, err = NewServerWithOptions(ctx, addr, Options{Ordered: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The new server knows nothing of the stream, so retransmissions start where it left off.
+	for want <= 100 {
+		v := receivePayload(t, server.Receive())
+		if v > want {
+			t.Fatal(want, v)
+		}
+		if v == want {
+			want++
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package netchan
+
+import (
+	"time"
+)
+
+// retryQueue holds messages without acknowledgement whose write failed, so they are handed
+// to the next connection instead of being lost. It also tracks consecutive failed writes
+// to compute the backoff before the next connection attempt.
+type retryQueue struct {
+	// lock is a channel used to control access to messages and failures (one at a time).
+	lock chan int
+	// messages waiting for the next connection, oldest first.
+	messages []Message
+	// failures counts failed writes since the last successful one.
+	failures int
+	// delay is the backoff after the first failure, it doubles after every further failure up to maxDelay.
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+// newRetryQueue creates an empty retry queue with the backoff of options.
+func newRetryQueue(options Options) *retryQueue {
+	return &retryQueue{
+		lock:     make(chan int, 1),
+		delay:    options.SendRetryDelay,
+		maxDelay: options.SendRetryMaxDelay,
+	}
+}
+
+// putBack puts a message in front of the queue, it is sent first on the next connection.
+func (q *retryQueue) putBack(message Message) {
+	q.lock <- 1
+	defer func() { <-q.lock }()
+
+	q.messages = append([]Message{message}, q.messages...)
+}
+
+// take removes and returns the oldest message.
+func (q *retryQueue) take() (Message, bool) {
+	q.lock <- 1
+	defer func() { <-q.lock }()
+
+	if len(q.messages) == 0 {
+		return Message{}, false
+	}
+	message := q.messages[0]
+	q.messages = q.messages[1:]
+	return message, true
+}
+
+// drain removes and returns all messages.
+func (q *retryQueue) drain() []Message {
+	q.lock <- 1
+	defer func() { <-q.lock }()
+
+	messages := q.messages
+	q.messages = nil
+	return messages
+}
+
+// failed records a failed write.
+func (q *retryQueue) failed() {
+	q.lock <- 1
+	defer func() { <-q.lock }()
+
+	q.failures++
+}
+
+// succeeded records a successful write, the backoff starts again.
+func (q *retryQueue) succeeded() {
+	q.lock <- 1
+	defer func() { <-q.lock }()
+
+	q.failures = 0
+}
+
+// backoff returns how long to wait before the next connection attempt, zero without failed writes.
+func (q *retryQueue) backoff() time.Duration {
+	q.lock <- 1
+	defer func() { <-q.lock }()
+
+	if q.failures == 0 {
+		return 0
+	}
+	delay := q.delay
+	for i := 1; i < q.failures && delay < q.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > q.maxDelay {
+		delay = q.maxDelay
+	}
+	return delay
+}
@@ -0,0 +1,78 @@
+package netchan
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failCodec is GobCodec whose encoders fail to write a message with payload "x" as long as fails is positive.
+type failCodec struct {
+	fails *atomic.Int64
+}
+
+type failEncoder struct {
+	Encoder
+	fails *atomic.Int64
+}
+
+func (c failCodec) NewEncoder(w io.Writer) Encoder {
+	return failEncoder{GobCodec{}.NewEncoder(w), c.fails}
+}
+
+func (c failCodec) NewDecoder(r io.Reader) Decoder {
+	return GobCodec{}.NewDecoder(r)
+}
+
+func (e failEncoder) Encode(v interface{}) error {
+	if m, ok := v.(Message); ok && m.Payload == "x" && e.fails.Add(-1) >= 0 {
+		return &net.OpError{Op: "write", Err: errors.New("broken pipe")}
+	}
+	return e.Encoder.Encode(v)
+}
+
+func TestRetryFailedWrite(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{})
+	fails := &atomic.Int64{}
+	fails.Store(2)
+	client := startClient(t, ctx, server.Addr().String(), Options{
+		Codec:          failCodec{fails},
+		SendRetryDelay: 50 * time.Millisecond,
+		RespawnDelay:   10 * time.Millisecond,
+	})
+	client.Send() <- Message{Payload: "x"}
+	client.Send() <- Message{Payload: "y"}
+	// The failed message is sent first on the next connection.
+	if m := receive(t, server.Receive()); m.Payload != "x" {
+		t.Fatal(m)
+	}
+	if m := receive(t, server.Receive()); m.Payload != "y" {
+		t.Fatal(m)
+	}
+}
+
+func TestRetryAttempts(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{})
+	fails := &atomic.Int64{}
+	fails.Store(5)
+	client := startClient(t, ctx, server.Addr().String(), Options{
+		Codec:             failCodec{fails},
+		SendRetryAttempts: 2,
+		SendRetryDelay:    10 * time.Millisecond,
+		RespawnDelay:      10 * time.Millisecond,
+		Reliable:          true,
+	})
+	client.Send() <- Message{Payload: "x"}
+	if d := receiveDeadLetter(t, client.DeadLetters()); !errors.Is(d.Reason, ErrSendFailed) {
+		t.Fatal(d)
+	}
+	client.Send() <- Message{Payload: "z"}
+	if m := receive(t, server.Receive()); m.Payload != "z" {
+		t.Fatal(m)
+	}
+}
@@ -0,0 +1,165 @@
+package netchan
+
+import (
+	"context"
+	"strconv"
+)
+
+// Handler serves a call from a client. The request is the KindCall message with
+// From set to the client address. The returned reply or error is sent back to the caller.
+// ctx is canceled when the caller gives up or the server stops.
+type Handler func(ctx context.Context, request Message) (reply interface{}, err error)
+
+// RemoteError is returned by Client.Call when the server Handler returned an error.
+type RemoteError struct {
+	Message string // text of the error returned by the Handler
+}
+
+// Error implements the error interface.
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// Handle registers the handler for calls from clients, replacing the previous one.
+// Without a handler calls fail with ErrNoHandler.
+func (s *Server) Handle(handler Handler) {
+	s.handlerLock <- 1
+	defer func() { <-s.handlerLock }()
+
+	s.handler = handler
+}
+
+// callKey identifies a running call of client from.
+func callKey(from string, callID uint64) string {
+	return from + "#" + strconv.FormatUint(callID, 10)
+}
+
+// serveCall runs the handler for a KindCall message in its own goroutine and routes the reply
+// to the caller, a KindCancel message cancels the context of the running handler.
+// It reports whether the message was a call or a cancel.
+func (s *Server) serveCall(request Message) bool {
+	switch request.Kind {
+	case KindCall:
+	case KindCancel:
+		s.callsLock <- 1
+		cancel, ok := s.calls[callKey(request.From, request.CallID)]
+		<-s.callsLock
+		if ok {
+			cancel()
+		}
+		return true
+	default:
+		return false
+	}
+
+	s.handlerLock <- 1
+	handler := s.handler
+	<-s.handlerLock
+
+	// The context is registered before the next message is read, so a cancel never comes before it.
+	key := callKey(request.From, request.CallID)
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.callsLock <- 1
+	s.calls[key] = cancel
+	<-s.callsLock
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		defer func() {
+			s.callsLock <- 1
+			delete(s.calls, key)
+			<-s.callsLock
+			cancel()
+		}()
+
+		reply := Message{Kind: KindReply, To: request.From, CallID: request.CallID}
+		if handler == nil {
+			reply.Error = ErrNoHandler.Error()
+		} else {
+			payload, err := handler(ctx, request)
+			reply.Payload = payload
+			if err != nil {
+				reply.Error = err.Error()
+			}
+		}
+
+		select {
+		case s.internalSend <- reply:
+		case <-s.ctx.Done():
+		}
+	}()
+	return true
+}
+
+// Call sends payload to the server Handler and waits for its reply.
+// It returns ctx.Err() when ctx is done before the reply arrives, the context of the Handler
+// is canceled then too. It returns ErrClosed when the client stops, ErrNoHandler when
+// the server has no Handler, and *RemoteError when the Handler returned an error.
+func (c *Client) Call(ctx context.Context, payload interface{}) (reply interface{}, err error) {
+	// Register a waiter for the reply before sending the request.
+	replyChan := make(chan Message, 1)
+	c.callsLock <- 1
+	c.lastCallID++
+	callID := c.lastCallID
+	c.calls[callID] = replyChan
+	<-c.callsLock
+
+	defer func() {
+		c.callsLock <- 1
+		delete(c.calls, callID)
+		<-c.callsLock
+	}()
+
+	request := Message{Kind: KindCall, To: c.addr, CallID: callID, Payload: payload}
+	select {
+	case c.internalSend <- request:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, ErrClosed
+	}
+
+	select {
+	case response := <-replyChan:
+		switch response.Error {
+		case "":
+			return response.Payload, nil
+		case ErrNoHandler.Error():
+			return nil, ErrNoHandler
+		default:
+			return nil, &RemoteError{Message: response.Error}
+		}
+	case <-ctx.Done():
+		// Stop the Handler, the request is sent before the cancel frame.
+		go func() {
+			select {
+			case c.internalSend <- Message{Kind: KindCancel, To: c.addr, CallID: callID}:
+			case <-c.ctx.Done():
+			}
+		}()
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, ErrClosed
+	}
+}
+
+// deliverReply hands a KindReply message to the waiting Call. It reports whether the message was a reply.
+func (c *Client) deliverReply(response Message) bool {
+	if response.Kind != KindReply {
+		return false
+	}
+
+	c.callsLock <- 1
+	replyChan, ok := c.calls[response.CallID]
+	<-c.callsLock
+
+	if ok {
+		select {
+		case replyChan <- response:
+		default:
+		}
+	}
+	// Replies for canceled calls are dropped.
+	return true
+}
@@ -0,0 +1,67 @@
+package netchan
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCall(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{})
+	client := startClient(t, ctx, server.Addr().String(), Options{})
+	if _, err := client.Call(ctx, 1); err != ErrNoHandler {
+		t.Fatal(err)
+	}
+
+	server.Handle(func(ctx context.Context, request Message) (interface{}, error) {
+		if request.Payload.(int) < 0 {
+			return nil, errors.New("negative")
+		}
+		return request.Payload.(int) * 2, nil
+	})
+	for i := 0; i < 10; i++ {
+		reply, err := client.Call(ctx, i)
+		if err != nil || reply.(int) != 2*i {
+			t.Fatal(reply, err)
+		}
+	}
+	var remote *RemoteError
+	if _, err := client.Call(ctx, -1); !errors.As(err, &remote) {
+		t.Fatal(err)
+	}
+}
+
+func TestCallCancel(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{})
+	client := startClient(t, ctx, server.Addr().String(), Options{})
+	canceled := make(chan struct{})
+	server.Handle(func(ctx context.Context, request Message) (interface{}, error) {
+		select {
+		case <-ctx.Done():
+			close(canceled)
+		case <-time.After(testTimeout):
+		}
+		return nil, ctx.Err()
+	})
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.Call(timeout, 1); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	// The handler learns that the caller gave up.
+	select {
+	case <-canceled:
+	case <-time.After(testTimeout):
+		t.Fatal("handler not canceled")
+	}
+
+	// Calls do not depend on the send channel.
+	close(client.Send())
+	server.Handle(func(ctx context.Context, request Message) (interface{}, error) { return 5, nil })
+	if reply, err := client.Call(ctx, 1); err != nil || reply.(int) != 5 {
+		t.Fatal(reply, err)
+	}
+}
@@ -12,10 +12,10 @@ import (
 	"time"
 )
 
-// generateSelfSignedCert creates a self-signed TLS certificate.
+// generateSelfSignedCert creates a self-signed TLS certificate for usage.
 // It generates an ECDSA private key, creates a certificate template, and signs the certificate with its own key.
 // It returns the PEM encoded certificate and private key, or an error in case of failure.
-func generateSelfSignedCert() ([]byte, []byte, error) {
+func generateSelfSignedCert(usage x509.ExtKeyUsage) ([]byte, []byte, error) {
 	// Generate an ECDSA private key using the P256 curve.
 	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
@@ -41,7 +41,7 @@ func generateSelfSignedCert() ([]byte, []byte, error) {
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 	}
@@ -70,7 +70,7 @@ func generateSelfSignedCert() ([]byte, []byte, error) {
 // Returns the TLS configuration or an error in case of failure.
 func generateTLSConfig() (*tls.Config, error) {
 	// Generate self-signed certificate.
-	certPEM, keyPEM, err := generateSelfSignedCert()
+	certPEM, keyPEM, err := generateSelfSignedCert(x509.ExtKeyUsageServerAuth)
 	if err != nil {
 		return nil, err
 	}
@@ -90,3 +90,13 @@ func generateTLSConfig() (*tls.Config, error) {
 
 	return tlsConfig, nil
 }
+
+// NewClientCertificate creates a self-signed certificate with a new key for Options.ClientCertificate.
+// Every new key is a new peer ID, load a stored key pair with tls.LoadX509KeyPair to keep it across restarts.
+func NewClientCertificate() (tls.Certificate, error) {
+	certPEM, keyPEM, err := generateSelfSignedCert(x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
@@ -0,0 +1,219 @@
+package netchan
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Topics are dot separated tokens like "orders.eu.created". In a subscription pattern
+// "*" matches exactly one token and ">" as the last token matches one or more tokens,
+// so "orders.*.created" and "orders.>" both match "orders.eu.created".
+
+// checkTopic returns an error wrapping ErrInvalidTopic if topic is empty, has an empty token
+// or, unless wildcards is set, contains a wildcard token.
+func checkTopic(topic string, wildcards bool) error {
+	if topic == "" {
+		return fmt.Errorf("%w: empty topic", ErrInvalidTopic)
+	}
+	tokens := strings.Split(topic, ".")
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return fmt.Errorf("%w: empty token in %q", ErrInvalidTopic, topic)
+		case (token == "*" || token == ">") && !wildcards:
+			return fmt.Errorf("%w: wildcard in %q", ErrInvalidTopic, topic)
+		case token == ">" && i != len(tokens)-1:
+			return fmt.Errorf("%w: \">\" is not the last token in %q", ErrInvalidTopic, topic)
+		}
+	}
+	return nil
+}
+
+// matchTopic reports whether topic matches the subscription pattern.
+func matchTopic(pattern string, topic string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	topicTokens := strings.Split(topic, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(topicTokens) > i
+		}
+		if i >= len(topicTokens) || (token != "*" && token != topicTokens[i]) {
+			return false
+		}
+	}
+	return len(topicTokens) == len(patternTokens)
+}
+
+// subscriptions holds the topic patterns every peer subscribed to.
+type subscriptions struct {
+	// lock is a channel used to control access to peers (one at a time).
+	lock chan int
+	// peers maps a peer address to its set of patterns.
+	peers map[string]map[string]struct{}
+}
+
+// newSubscriptions creates an empty subscription table.
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		lock:  make(chan int, 1),
+		peers: make(map[string]map[string]struct{}),
+	}
+}
+
+// add subscribes peer to pattern.
+func (s *subscriptions) add(peer string, pattern string) {
+	s.lock <- 1
+	defer func() { <-s.lock }()
+
+	patterns, ok := s.peers[peer]
+	if !ok {
+		patterns = make(map[string]struct{})
+		s.peers[peer] = patterns
+	}
+	patterns[pattern] = struct{}{}
+}
+
+// remove unsubscribes peer from pattern.
+func (s *subscriptions) remove(peer string, pattern string) {
+	s.lock <- 1
+	defer func() { <-s.lock }()
+
+	delete(s.peers[peer], pattern)
+	if len(s.peers[peer]) == 0 {
+		delete(s.peers, peer)
+	}
+}
+
+// drop removes every subscription of peer, for example after it disconnected.
+func (s *subscriptions) drop(peer string) {
+	s.lock <- 1
+	defer func() { <-s.lock }()
+
+	delete(s.peers, peer)
+}
+
+// match returns the peers with at least one pattern matching topic, sorted by address.
+func (s *subscriptions) match(topic string) []string {
+	s.lock <- 1
+	defer func() { <-s.lock }()
+
+	var peers []string
+	for peer, patterns := range s.peers {
+		for pattern := range patterns {
+			if matchTopic(pattern, topic) {
+				peers = append(peers, peer)
+				break
+			}
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// patterns returns the patterns of peer, sorted.
+func (s *subscriptions) patterns(peer string) []string {
+	s.lock <- 1
+	defer func() { <-s.lock }()
+
+	patterns := make([]string, 0, len(s.peers[peer]))
+	for pattern := range s.peers[peer] {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// Publish sends payload to every client subscribed to a pattern matching topic.
+// It works like sending a message with Topic set and an empty To on Send.
+// Clients which are not connected at this moment do not get it.
+// It returns ErrClosed when the server stopped or Send was closed.
+func (s *Server) Publish(topic string, payload interface{}) error {
+	if err := checkTopic(topic, false); err != nil {
+		return err
+	}
+	s.accessLock <- 1
+	closed := s.sendClosed
+	<-s.accessLock
+	if closed || s.ctx.Err() != nil {
+		return ErrClosed
+	}
+	select {
+	case s.appSend <- Message{Topic: topic, Payload: payload}:
+		return nil
+	case <-s.ctx.Done():
+		return ErrClosed
+	}
+}
+
+// serveTopic handles subscription frames and messages published by a client.
+// It reports whether the message was one of them.
+func (s *Server) serveTopic(message Message) bool {
+	switch {
+	case message.Kind == KindSubscribe:
+		if checkTopic(message.Topic, true) == nil {
+			s.topics.add(message.From, message.Topic)
+		}
+		return true
+	case message.Kind == KindUnsubscribe:
+		s.topics.remove(message.From, message.Topic)
+		return true
+	case message.Kind == KindData && message.Topic != "":
+		// Published by a client, route fans it out like a publish of the server.
+		message.To = ""
+		select {
+		case s.internalSend <- message:
+		case <-s.ctx.Done():
+		}
+		return true
+	}
+	return false
+}
+
+// Subscribe subscribes the client to topics matching pattern, see Message.Topic.
+// Published messages arrive on Receive with their Topic. Subscriptions are sent
+// again after every reconnect. Like Call, it does not use the send channel, so it also works after it was closed.
+func (c *Client) Subscribe(pattern string) error {
+	if err := checkTopic(pattern, true); err != nil {
+		return err
+	}
+	c.topics.add("", pattern)
+	return c.control(Message{Kind: KindSubscribe, Topic: pattern})
+}
+
+// Unsubscribe cancels a subscription made with Subscribe.
+func (c *Client) Unsubscribe(pattern string) error {
+	c.topics.remove("", pattern)
+	return c.control(Message{Kind: KindUnsubscribe, Topic: pattern})
+}
+
+// Publish sends payload through the server to every client subscribed to a pattern matching topic,
+// including this one if it subscribed.
+func (c *Client) Publish(topic string, payload interface{}) error {
+	if err := checkTopic(topic, false); err != nil {
+		return err
+	}
+	return c.control(Message{Topic: topic, Payload: payload, To: c.addr})
+}
+
+// control puts a message on the internal send channel unless the client stops.
+func (c *Client) control(message Message) error {
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+	select {
+	case c.internalSend <- message:
+		return nil
+	case <-c.ctx.Done():
+		return ErrClosed
+	}
+}
+
+// subscribeFrames returns the frames which subscribe a new connection to every pattern of the client.
+func (c *Client) subscribeFrames() []Message {
+	var frames []Message
+	for _, pattern := range c.topics.patterns("") {
+		frames = append(frames, Message{Kind: KindSubscribe, Topic: pattern})
+	}
+	return frames
+}
@@ -0,0 +1,99 @@
+package netchan
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	for _, c := range []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"a", "a", true},
+		{"a.*.c", "a.b.c", true},
+		{"a.*", "a.b.c", false},
+		{"a.>", "a.b.c", true},
+		{"a.>", "a", false},
+	} {
+		if matchTopic(c.pattern, c.topic) != c.match {
+			t.Fatal(c)
+		}
+	}
+	if checkTopic("a.>.b", true) == nil || checkTopic("a.*", false) == nil || checkTopic("a..b", true) == nil {
+		t.Fatal("invalid topic accepted")
+	}
+}
+
+func TestTopics(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{})
+	a := startClient(t, ctx, server.Addr().String(), Options{})
+	b := startClient(t, ctx, server.Addr().String(), Options{})
+	if err := a.Subscribe("orders.>"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Subscribe("orders.*.created"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if err := server.Publish("orders.eu.created", 1); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, a.Receive()); m.Payload.(int) != 1 || m.Topic != "orders.eu.created" {
+		t.Fatal(m)
+	}
+	if v := receivePayload(t, b.Receive()); v != 1 {
+		t.Fatal(v)
+	}
+	if err := b.Publish("orders.eu.deleted", 2); err != nil {
+		t.Fatal(err)
+	}
+	if v := receivePayload(t, a.Receive()); v != 2 {
+		t.Fatal(v)
+	}
+
+	// Subscriptions end with the connection or on Unsubscribe.
+	b.Close()
+	time.Sleep(200 * time.Millisecond)
+	if peers := server.topics.match("orders.eu.created"); len(peers) != 1 {
+		t.Fatal(peers)
+	}
+	if err := a.Unsubscribe("orders.>"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if peers := server.topics.match("orders.eu.created"); len(peers) != 0 {
+		t.Fatal(peers)
+	}
+}
+
+func TestTopicsAfterClose(t *testing.T) {
+	ctx := testContext(t)
+	server := startServer(t, ctx, Options{})
+	client := startClient(t, ctx, server.Addr().String(), Options{})
+
+	// Topics do not depend on the send channel of the client.
+	close(client.Send())
+	if err := client.Subscribe("a.*"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := client.Publish("a.b", 1); err != nil {
+		t.Fatal(err)
+	}
+	if v := receivePayload(t, client.Receive()); v != 1 {
+		t.Fatal(v)
+	}
+
+	close(server.Send())
+	time.Sleep(100 * time.Millisecond)
+	if err := server.Publish("a.b", 2); err != ErrClosed {
+		t.Fatal(err)
+	}
+	client.Close()
+	if err := client.Subscribe("x"); err != ErrClosed {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,160 @@
+package netchan
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+)
+
+// TypeMismatchError reports a received payload that does not have the type of a typed channel.
+type TypeMismatchError struct {
+	Want    string      // expected payload type
+	Payload interface{} // payload as it was received
+}
+
+// Error implements the error interface.
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("netchan: received payload of type %T, expected %s", e.Payload, e.Want)
+}
+
+// DialTyped works like DialWithOptions, but returns channels of type T.
+// Received payloads that are not of type T are dropped and reported
+// as *TypeMismatchError on the errs channel, messages the codec cannot decode,
+// for example of a type not registered here, as an error wrapping ErrDecode.
+// All returned channels except send are closed when ctx is canceled.
+// Closing send is propagated to the server.
+func DialTyped[T any](ctx context.Context, address string, options Options) (send chan<- T, receive <-chan T, errs <-chan error, err error) {
+	if err = registerGobType[T](options); err != nil {
+		return
+	}
+	r := newRendezvous(options)
+	client, dispatcherSend, dispatcherReceive, err := dialDispatcher(ctx, address, options, r)
+	if err != nil {
+		return
+	}
+	send, receive, errs = typedChannels[T](ctx, dispatcherSend, dispatcherReceive, client.Events(), r, options.withDefaults())
+	return
+}
+
+// ListenTyped works like ListenWithOptions, but returns channels of type T.
+// Received payloads that are not of type T are dropped and reported
+// as *TypeMismatchError on the errs channel, messages the codec cannot decode,
+// for example of a type not registered here, as an error wrapping ErrDecode.
+// All returned channels except send are closed when ctx is canceled.
+// Closing send is propagated to every client.
+func ListenTyped[T any](ctx context.Context, address string, options Options) (send chan<- T, receive <-chan T, errs <-chan error, err error) {
+	if err = registerGobType[T](options); err != nil {
+		return
+	}
+	r := newRendezvous(options)
+	server, dispatcherSend, dispatcherReceive, err := listenDispatcher(ctx, address, options, r)
+	if err != nil {
+		return
+	}
+	send, receive, errs = typedChannels[T](ctx, dispatcherSend, dispatcherReceive, server.Events(), r, options.withDefaults())
+	return
+}
+
+// typedChannels converts the untyped dispatcher channels into channels of type T.
+// DecodeError events are reported on the error channel, nobody else reads events of the dispatcher.
+// In Sync mode r keeps the typed channels as synchronous as the dispatcher channels.
+func typedChannels[T any](ctx context.Context, dispatcherSend chan interface{}, dispatcherReceive chan interface{}, events <-chan Event, r *rendezvous, options Options) (chan<- T, <-chan T, <-chan error) {
+	typedSend := make(chan T, options.sendBufferSize())
+	typedReceive := make(chan T, options.receiveBufferSize())
+	typedErrors := make(chan error, options.ReceiveBufferSize)
+
+	// Goroutine forwarding typed values to the dispatcher.
+	go func() {
+		for {
+			select {
+			case value, ok := <-typedSend:
+				if !ok {
+					// Propagate close to the peer.
+					close(dispatcherSend)
+					return
+				}
+				select {
+				case dispatcherSend <- value:
+				case <-ctx.Done():
+					return
+				}
+				// In Sync mode the next value is taken only after the peer application took this one.
+				if !await(ctx, r.sent) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// report hands err to the application without blocking the stream.
+	report := func(err error) {
+		select {
+		case typedErrors <- err:
+		default:
+			// Nobody reads errors, drop it.
+			options.Logger.Println(err)
+		}
+	}
+
+	// Goroutine checking payload types before handing them to the application.
+	go func() {
+		defer close(typedErrors)
+		defer close(typedReceive)
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+				if event.Type == DecodeError {
+					// The connection to the peer was dropped, the message never reached dispatcherReceive.
+					report(fmt.Errorf("%w from %s: %s", ErrDecode, event.Peer, event.Err))
+				}
+			case payload, ok := <-dispatcherReceive:
+				if !ok {
+					return
+				}
+				value, ok := payload.(T)
+				if !ok {
+					report(&TypeMismatchError{Want: reflect.TypeOf((*T)(nil)).Elem().String(), Payload: payload})
+				} else {
+					select {
+					case typedReceive <- value:
+					case <-ctx.Done():
+						return
+					}
+				}
+				// In Sync mode the peer waits until the application took the value.
+				if !notify(ctx, r.taken) {
+					return
+				}
+			}
+		}
+	}()
+
+	return typedSend, typedReceive, typedErrors
+}
+
+// registerGobType registers T with encoding/gob when the gob codec is used,
+// so concrete types can travel inside the interface typed Message.Payload.
+func registerGobType[T any](options Options) (err error) {
+	if _, ok := options.withDefaults().Codec.(GobCodec); !ok {
+		return nil
+	}
+	var zero T
+	if interface{}(zero) == nil {
+		// T is an interface type, its concrete types must be registered by the caller.
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("netchan: cannot register %T with gob: %v", zero, r)
+		}
+	}()
+	gob.Register(zero)
+	return nil
+}
@@ -0,0 +1,84 @@
+package netchan
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+type testJob struct {
+	ID   int
+	Name string
+}
+
+func TestTyped(t *testing.T) {
+	ctx := testContext(t)
+	addr := freeAddr(t)
+	serverSend, serverReceive, _, err := ListenTyped[testJob](ctx, addr, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSend, clientReceive, _, err := DialTyped[testJob](ctx, addr, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSend <- testJob{1, "a"}
+	if v := <-serverReceive; v != (testJob{1, "a"}) {
+		t.Fatal(v)
+	}
+	serverSend <- testJob{2, "b"}
+	if v := <-clientReceive; v != (testJob{2, "b"}) {
+		t.Fatal(v)
+	}
+}
+
+// poisonCodec is GobCodec whose decoders fail on a message with payload "poison".
+type poisonCodec struct{}
+
+type poisonDecoder struct {
+	Decoder
+}
+
+func (poisonCodec) NewEncoder(w io.Writer) Encoder {
+	return GobCodec{}.NewEncoder(w)
+}
+
+func (poisonCodec) NewDecoder(r io.Reader) Decoder {
+	return poisonDecoder{GobCodec{}.NewDecoder(r)}
+}
+
+func (d poisonDecoder) Decode(v interface{}) error {
+	if err := d.Decoder.Decode(v); err != nil {
+		return err
+	}
+	if m, ok := v.(*Message); ok && m.Payload == "poison" {
+		return errors.New("cannot decode poison")
+	}
+	return nil
+}
+
+func TestTypedDecodeError(t *testing.T) {
+	ctx := testContext(t)
+	addr := freeAddr(t)
+	options := Options{Codec: poisonCodec{}, RespawnDelay: 100 * time.Millisecond}
+	serverSend, _, _, err := ListenTyped[string](ctx, addr, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clientReceive, clientErrors, err := DialTyped[string](ctx, addr, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSend <- "poison"
+	select {
+	case err := <-clientErrors:
+		if !errors.Is(err, ErrDecode) {
+			t.Fatal(err)
+		}
+	case v := <-clientReceive:
+		t.Fatal(v)
+	case <-time.After(testTimeout):
+		t.Fatal("decode error not reported")
+	}
+}
@@ -1,13 +1,80 @@
 package netchan
 
+import (
+	"time"
+)
+
+// Kind tells regular data messages apart from protocol frames.
+type Kind uint8
+
+const (
+	// KindData is a regular message carrying Payload (zero value).
+	KindData Kind = iota
+	// KindClose tells that the sender closed its send channel and no more data follows.
+	KindClose
+	// KindAck confirms that the message with the same ID was handed to the receive channel.
+	KindAck
+	// KindCall is a request from Client.Call, answered by the server Handler.
+	KindCall
+	// KindReply is the answer to a KindCall message with the same CallID.
+	KindReply
+	// KindCredit allows the peer to send ID more messages in flow control mode.
+	KindCredit
+	// KindSubscribe subscribes the sender to topics matching the pattern in Topic.
+	KindSubscribe
+	// KindUnsubscribe cancels a KindSubscribe with the same Topic.
+	KindUnsubscribe
+	// KindCancel cancels the context of the Handler serving the KindCall with the same CallID.
+	KindCancel
+)
+
 type Message struct {
-	To      string      //recepient network address and port hash (plain text)
-	From    string      //sender network address and port hash (encrypted by recepient public key)
-	Payload interface{} //channel data packed in GOB (encrypted by recepient public key)
-	Secret  string      //random per session secret (encrypted by recepient public key)
+	To       string      //recepient network address and port hash (plain text)
+	From     string      //sender network address and port hash (encrypted by recepient public key)
+	Payload  interface{} //channel data packed in GOB (encrypted by recepient public key)
+	Secret   string      //random per session secret (encrypted by recepient public key)
+	Kind     Kind        //data message or protocol frame
+	ID       uint64      //message number given by the sender in reliable mode, number of credits in a KindCredit frame, zero otherwise
+	Origin   string      //random sender instance identifier, ID is unique per Origin
+	CallID   uint64      //correlation ID linking a KindReply to its KindCall
+	Error    string      //error returned by the Handler in a KindReply
+	Expires  time.Time   //message is dropped instead of delivered after this time, zero never expires
+	Priority Priority    //messages with higher priority overtake others waiting on the same connection
+	Seq      uint64      //position in the stream of Origin in ordered mode, zero otherwise
+	Channel  string      //name of the logical channel opened with OpenChannel, empty for the main channel
+	Topic    string      //topic of a published message or pattern of a subscription, empty for point-to-point messages
+
+	attempts int        //failed writes of this message so far, never sent to the peer
+	done     chan error //gets nil when the peer acknowledged the message or the reason it was given up, set by SendSync
+
+	handedOver chan struct{} //closed by the Dial or Listen dispatcher when the application took the message in Sync mode
+}
+
+// finish reports the outcome of the message to a waiting SendSync, if any.
+func (m Message) finish(err error) {
+	if m.done == nil {
+		return
+	}
+	select {
+	case m.done <- err:
+	default:
+	}
+}
+
+// handOver tells the connection that the application took the received message,
+// so it can be acknowledged. It does nothing unless the connection waits for it.
+func (m Message) handOver() {
+	if m.handedOver != nil {
+		close(m.handedOver)
+	}
+}
+
+// expired reports whether the message has a deadline which passed before now.
+func (m Message) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && now.After(m.Expires)
 }
 
-// addressBook is a struct to hold the send channel for each connected client.
+// addressBook is a struct to hold the send lanes for each connected client.
 type addressBook struct {
-	Send chan Message
+	Send lanes
 }